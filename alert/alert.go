@@ -0,0 +1,179 @@
+// Package alert posts webhook notifications about runs that need attention:
+// failures, empty loads on business days, rejected rows and sync lag.
+//
+// It is configured through the environment:
+//
+//	MAE_ALERT_WEBHOOK_URL   where alerts are POSTed; alerting is off when unset
+//	MAE_ALERT_FORMAT        json (default) or slack, for Slack incoming webhooks
+//	MAE_ALERT_REPEAT        how long an alert that keeps firing stays quiet
+//	                        before it is sent again (default 6h)
+//	MAE_ALERT_STATE_DIR     where the alerts already sent are remembered
+//	                        (default maescraper/alerts under the user cache dir)
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Severities
+const (
+	Critical = "critical"
+	Warning  = "warning"
+)
+
+// Alert is a condition found at the end of a run.
+type Alert struct {
+	Key      string `json:"key"` // identifies the condition within the command, for deduplication
+	Severity string `json:"severity"`
+	Title    string `json:"title"`
+	Text     string `json:"text,omitempty"`
+}
+
+// message is the generic JSON payload, one per alert.
+type message struct {
+	Status  string    `json:"status"` // firing or resolved
+	Command string    `json:"command"`
+	RunID   string    `json:"run_id"`
+	Time    time.Time `json:"time"`
+	Alert
+	Repeats int `json:"repeats,omitempty"` // times it fired since it was last sent
+}
+
+// Notify sends the alerts found by a run of the command, and a resolved
+// notification for each alert sent by an earlier run that no longer fires.
+// An alert already sent within MAE_ALERT_REPEAT is not sent again. Errors are
+// only logged: alerting never changes the outcome of a run.
+func Notify(command, runID string, alerts []Alert) {
+	url := os.Getenv("MAE_ALERT_WEBHOOK_URL")
+	if url == "" {
+		return
+	}
+	n := &notifier{url: url, format: os.Getenv("MAE_ALERT_FORMAT"), client: &http.Client{Timeout: 10 * time.Second}}
+	if err := n.notify(command, runID, alerts, stateDir(), repeatInterval(), time.Now()); err != nil {
+		slog.Warn("Unable to send alerts", "error", err)
+	}
+}
+
+type notifier struct {
+	url    string
+	format string
+	client *http.Client
+}
+
+func (n *notifier) notify(command, runID string, alerts []Alert, dir string, repeat time.Duration, now time.Time) error {
+	st, err := loadState(dir, command)
+	if err != nil {
+		// Better a repeated alert than a lost one
+		slog.Warn("Unable to read alert state, sending all alerts", "error", err)
+		st = state{}
+	}
+
+	firing := make(map[string]bool, len(alerts))
+	for _, a := range alerts {
+		firing[a.Key] = true
+		sent, ok := st[a.Key]
+		if ok && now.Sub(sent.LastSent) < repeat {
+			sent.Repeats++
+			st[a.Key] = sent
+			slog.Info("Alert already sent", "key", a.Key, "last_sent", sent.LastSent)
+			continue
+		}
+		m := message{Status: "firing", Command: command, RunID: runID, Time: now, Alert: a, Repeats: sent.Repeats}
+		if err := n.post(m); err != nil {
+			slog.Warn("Unable to send alert", "key", a.Key, "error", err)
+			continue
+		}
+		slog.Info("Alert sent", "key", a.Key, "severity", a.Severity)
+		st[a.Key] = sentAlert{Alert: a, FirstSent: firstSent(sent, ok, now), LastSent: now}
+	}
+
+	for key, sent := range st {
+		if firing[key] {
+			continue
+		}
+		m := message{Status: "resolved", Command: command, RunID: runID, Time: now, Alert: sent.Alert}
+		if err := n.post(m); err != nil {
+			slog.Warn("Unable to send resolved alert", "key", key, "error", err)
+			continue
+		}
+		slog.Info("Alert resolved", "key", key)
+		delete(st, key)
+	}
+	return st.save(dir, command)
+}
+
+func firstSent(sent sentAlert, ok bool, now time.Time) time.Time {
+	if ok {
+		return sent.FirstSent
+	}
+	return now
+}
+
+// post sends one message in the configured format.
+func (n *notifier) post(m message) error {
+	var payload any = m
+	if n.format == "slack" {
+		payload = slackPayload(m)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// slackPayload is the message for a Slack incoming webhook, which also works
+// with Mattermost and Rocket.Chat.
+func slackPayload(m message) map[string]string {
+	mark := ":rotating_light:"
+	switch {
+	case m.Status == "resolved":
+		mark = ":white_check_mark:"
+	case m.Severity == Warning:
+		mark = ":warning:"
+	}
+	text := fmt.Sprintf("%s *[%s] %s* — %s", mark, m.Status, m.Title, m.Command)
+	if m.Status == "firing" && m.Text != "" {
+		text += "\n" + m.Text
+	}
+	if m.Repeats > 0 {
+		text += fmt.Sprintf("\n(fired %d more times since the last notification)", m.Repeats)
+	}
+	return map[string]string{"text": text + "\nrun " + m.RunID}
+}
+
+// repeatInterval is MAE_ALERT_REPEAT, 6 hours by default.
+func repeatInterval() time.Duration {
+	v := os.Getenv("MAE_ALERT_REPEAT")
+	if v == "" {
+		return 6 * time.Hour
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		slog.Warn("Invalid MAE_ALERT_REPEAT, using 6h", "value", v)
+		return 6 * time.Hour
+	}
+	return d
+}
@@ -0,0 +1,86 @@
+package alert
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotifyDeduplicates(t *testing.T) {
+	var got []map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var m map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			t.Errorf("payload is not JSON: %v", err)
+		}
+		got = append(got, m)
+	}))
+	defer srv.Close()
+
+	n := &notifier{url: srv.URL, client: srv.Client()}
+	dir := t.TempDir()
+	failed := Alert{Key: "failed", Severity: Critical, Title: "maescraper failed: source_error"}
+	start := time.Date(2024, 11, 15, 18, 0, 0, 0, time.UTC)
+
+	steps := []struct {
+		after  time.Duration
+		alerts []Alert
+		want   string // status of the message sent, if any
+	}{
+		{0, []Alert{failed}, "firing"},
+		{time.Hour, []Alert{failed}, ""},
+		{7 * time.Hour, []Alert{failed}, "firing"},
+		{8 * time.Hour, nil, "resolved"},
+		{9 * time.Hour, nil, ""},
+	}
+	for i, s := range steps {
+		got = nil
+		if err := n.notify("maescraper", "r1", s.alerts, dir, 6*time.Hour, start.Add(s.after)); err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case s.want == "" && len(got) != 0:
+			t.Errorf("step %d: sent %v, want nothing", i, got)
+		case s.want != "" && (len(got) != 1 || got[0]["status"] != s.want || got[0]["key"] != "failed"):
+			t.Errorf("step %d: sent %v, want one %s message for key failed", i, got, s.want)
+		}
+	}
+}
+
+func TestNotifyRetriesFailedPost(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	n := &notifier{url: srv.URL, client: srv.Client()}
+	dir := t.TempDir()
+	a := []Alert{{Key: "no_data", Severity: Warning, Title: "maescraper loaded no rows"}}
+	now := time.Now()
+	for range 2 {
+		if err := n.notify("maescraper", "r1", a, dir, time.Hour, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("webhook called %d times, want a retry after the failed post", calls)
+	}
+}
+
+func TestSlackPayload(t *testing.T) {
+	m := message{Status: "firing", Command: "syncforex sync", RunID: "r1", Repeats: 3,
+		Alert: Alert{Key: "lag:gcloud:public.forex", Severity: Warning, Title: "public.forex in gcloud is 4 days behind"}}
+	text := slackPayload(m)["text"]
+	for _, want := range []string{":warning:", "*[firing] public.forex in gcloud is 4 days behind*", "3 more times", "run r1"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("text %q does not contain %q", text, want)
+		}
+	}
+}
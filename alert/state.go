@@ -0,0 +1,75 @@
+package alert
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// state is what has been sent for one command, by alert key. Each command has
+// its own file, so commands running at the same time never overwrite each
+// other's.
+type state map[string]sentAlert
+
+type sentAlert struct {
+	Alert     Alert     `json:"alert"`
+	FirstSent time.Time `json:"first_sent"`
+	LastSent  time.Time `json:"last_sent"`
+	Repeats   int       `json:"repeats"` // times it fired without being sent
+}
+
+// stateDir is MAE_ALERT_STATE_DIR, or maescraper/alerts under the user cache
+// directory.
+func stateDir() string {
+	if dir := os.Getenv("MAE_ALERT_STATE_DIR"); dir != "" {
+		return dir
+	}
+	if cache, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(cache, "maescraper", "alerts")
+	}
+	return "alerts"
+}
+
+func statePath(dir, command string) string {
+	return filepath.Join(dir, strings.ReplaceAll(command, " ", "_")+".json")
+}
+
+func loadState(dir, command string) (state, error) {
+	body, err := os.ReadFile(statePath(dir, command))
+	if errors.Is(err, os.ErrNotExist) {
+		return state{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	st := state{}
+	return st, json.Unmarshal(body, &st)
+}
+
+// save writes the state under a temporary name and renames it, so a crash
+// never leaves a truncated file.
+func (st state) save(dir, command string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	body, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".state-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), statePath(dir, command))
+}
@@ -0,0 +1,47 @@
+// Package calendar knows the market's time zone and business days, for
+// alerts and the scheduler.
+package calendar
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// BuenosAires is the market's time zone, with a fixed UTC-3 fallback for
+// systems without the time zone database.
+var BuenosAires = loadLocation()
+
+func loadLocation() *time.Location {
+	loc, err := time.LoadLocation("America/Argentina/Buenos_Aires")
+	if err != nil {
+		return time.FixedZone("ART", -3*60*60)
+	}
+	return loc
+}
+
+// BusinessDay tells whether the market trades on the day of t in Buenos
+// Aires: a weekday that is not listed in MAE_HOLIDAYS, comma separated
+// YYYY-MM-DD dates.
+func BusinessDay(t time.Time) bool {
+	t = t.In(BuenosAires)
+	if t.Weekday() == time.Saturday || t.Weekday() == time.Sunday {
+		return false
+	}
+	day := t.Format("2006-01-02")
+	for _, h := range strings.Split(os.Getenv("MAE_HOLIDAYS"), ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", h); err != nil {
+			slog.Warn("Invalid date in MAE_HOLIDAYS", "value", h)
+			continue
+		}
+		if h == day {
+			return false
+		}
+	}
+	return true
+}
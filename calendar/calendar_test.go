@@ -0,0 +1,25 @@
+package calendar
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBusinessDay(t *testing.T) {
+	t.Setenv("MAE_HOLIDAYS", "2024-11-18, bad")
+	tests := []struct {
+		t    time.Time
+		want bool
+	}{
+		{time.Date(2024, 11, 15, 12, 0, 0, 0, time.UTC), true},  // Friday
+		{time.Date(2024, 11, 16, 1, 0, 0, 0, time.UTC), true},   // still Friday in Buenos Aires
+		{time.Date(2024, 11, 16, 12, 0, 0, 0, time.UTC), false}, // Saturday
+		{time.Date(2024, 11, 18, 12, 0, 0, 0, time.UTC), false}, // holiday
+		{time.Date(2024, 11, 19, 12, 0, 0, 0, time.UTC), true},
+	}
+	for _, tt := range tests {
+		if got := BusinessDay(tt.t); got != tt.want {
+			t.Errorf("BusinessDay(%s) = %v, want %v", tt.t, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Package config reads the maescraper configuration file. Its settings are
+// the environment variables the commands read, e.g. POSTGRES_HOST or
+// SYNC_DESTINATIONS_FILE, given for every profile and per named profile:
+//
+//	profile: local            # used when no other is selected
+//	defaults:
+//	  MAE_LOG_FORMAT: json
+//	profiles:
+//	  local:
+//	    POSTGRES_HOST: localhost
+//	    POSTGRES_DB: forex3
+//	  gcloud:
+//	    POSTGRES_HOST: 10.20.0.3
+//	    POSTGRES_DB: forex
+//
+// The variables already set in the environment override the file. The jobs
+// of the scheduler are defined in the same file, see Job.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultName is the file looked for in the working directory when no other
+// is given.
+const DefaultName = "maescraper.yaml"
+
+// File is a parsed configuration file.
+type File struct {
+	Path     string                       `yaml:"-"`
+	Profile  string                       `yaml:"profile"`
+	Defaults map[string]string            `yaml:"defaults"`
+	Profiles map[string]map[string]string `yaml:"profiles"`
+	Jobs     []Job                        `yaml:"jobs"`
+}
+
+// Job is a command run by the scheduler (maescraper schedule), either on a
+// cron schedule or after other jobs succeed:
+//
+//	jobs:
+//	  - name: fetch
+//	    command: fetch
+//	    schedule: "30 17 * * 1-5"   # Buenos Aires time
+//	    retries: 3
+//	    retry_delay: 10m
+//	  - name: sync
+//	    command: sync cdc
+//	    after: [fetch]
+//	    profile: gcloud
+type Job struct {
+	Name         string   `yaml:"name"`
+	Command      string   `yaml:"command"`       // maescraper command and arguments
+	Schedule     string   `yaml:"schedule"`      // cron expression or descriptor such as @daily
+	After        []string `yaml:"after"`         // jobs that must succeed first, instead of a schedule
+	BusinessDays *bool    `yaml:"business_days"` // run on business days only, the default
+	Retries      int      `yaml:"retries"`       // extra attempts after a retryable failure
+	RetryDelay   string   `yaml:"retry_delay"`   // between attempts, default 5m
+	Timeout      string   `yaml:"timeout"`       // the job is stopped after it, default none
+	Profile      string   `yaml:"profile"`       // profile to run with instead of the scheduler's
+}
+
+// Find returns the configuration file to use: path if given, else
+// maescraper.yaml in the working directory or maescraper/config.yaml under
+// the user config directory, whichever exists first. It returns "" when
+// there is none.
+func Find(path string) string {
+	if path != "" {
+		return path
+	}
+	candidates := []string{DefaultName}
+	if dir, err := os.UserConfigDir(); err == nil {
+		candidates = append(candidates, filepath.Join(dir, "maescraper", "config.yaml"))
+	}
+	for _, c := range candidates {
+		if _, err := os.Stat(c); err == nil {
+			return c
+		}
+	}
+	return ""
+}
+
+// Load reads and checks the file.
+func Load(path string) (*File, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{Path: path}
+	dec := yaml.NewDecoder(bytes.NewReader(body))
+	dec.KnownFields(true)
+	if err := dec.Decode(f); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := checkNames(f.Defaults); err != nil {
+		return nil, fmt.Errorf("%s: defaults: %w", path, err)
+	}
+	for name, settings := range f.Profiles {
+		if err := checkNames(settings); err != nil {
+			return nil, fmt.Errorf("%s: profile %s: %w", path, name, err)
+		}
+	}
+	if f.Profile != "" && f.Profiles[f.Profile] == nil {
+		return nil, fmt.Errorf("%s: default profile %q is not defined", path, f.Profile)
+	}
+	return f, nil
+}
+
+var envName = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+
+// checkNames rejects settings that cannot be environment variables, which
+// are most likely typos.
+func checkNames(settings map[string]string) error {
+	for name := range settings {
+		if !envName.MatchString(name) {
+			return fmt.Errorf("invalid setting %q, use the environment variable name", name)
+		}
+	}
+	return nil
+}
+
+// Settings are the defaults overridden by the profile's settings. An empty
+// profile selects the file's default profile, if any.
+func (f *File) Settings(profile string) (map[string]string, error) {
+	if profile == "" {
+		profile = f.Profile
+	}
+	settings := make(map[string]string, len(f.Defaults))
+	for k, v := range f.Defaults {
+		settings[k] = v
+	}
+	if profile == "" {
+		return settings, nil
+	}
+	p, ok := f.Profiles[profile]
+	if !ok {
+		return nil, fmt.Errorf("%s: unknown profile %q (defined: %s)", f.Path, profile, strings.Join(f.ProfileNames(), ", "))
+	}
+	for k, v := range p {
+		settings[k] = v
+	}
+	return settings, nil
+}
+
+// ProfileNames are the names of the profiles, sorted.
+func (f *File) ProfileNames() []string {
+	names := make([]string, 0, len(f.Profiles))
+	for name := range f.Profiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Apply sets the environment variables of the settings that are not already
+// set, so the environment overrides the file.
+func Apply(settings map[string]string) {
+	for k, v := range settings {
+		if _, set := os.LookupEnv(k); !set {
+			os.Setenv(k, v)
+		}
+	}
+}
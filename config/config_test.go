@@ -0,0 +1,98 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const sample = `
+profile: local
+defaults:
+  MAE_LOG_FORMAT: json
+  POSTGRES_PORT: 5432
+profiles:
+  local:
+    POSTGRES_HOST: localhost
+  gcloud:
+    POSTGRES_HOST: 10.20.0.3
+    MAE_LOG_FORMAT: text
+`
+
+func write(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "maescraper.yaml")
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSettings(t *testing.T) {
+	f, err := Load(write(t, sample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		profile string
+		want    map[string]string
+	}{
+		{"", map[string]string{"MAE_LOG_FORMAT": "json", "POSTGRES_PORT": "5432", "POSTGRES_HOST": "localhost"}},
+		{"gcloud", map[string]string{"MAE_LOG_FORMAT": "text", "POSTGRES_PORT": "5432", "POSTGRES_HOST": "10.20.0.3"}},
+	}
+	for _, tt := range tests {
+		got, err := f.Settings(tt.profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range tt.want {
+			if got[k] != v {
+				t.Errorf("profile %q: %s = %q, want %q", tt.profile, k, got[k], v)
+			}
+		}
+	}
+	if _, err := f.Settings("test"); err == nil || !strings.Contains(err.Error(), "gcloud, local") {
+		t.Errorf("unknown profile error = %v, want one listing the profiles", err)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for name, body := range map[string]string{
+		"lowercase name":  "defaults:\n  postgres_host: x\n",
+		"unknown field":   "profiles: {}\ndestinations: []\n",
+		"missing default": "profile: test\nprofiles:\n  local: {}\n",
+	} {
+		if _, err := Load(write(t, body)); err == nil {
+			t.Errorf("%s: Load() succeeded", name)
+		}
+	}
+	if _, err := Load(write(t, "")); err != nil {
+		t.Errorf("empty file: %v", err)
+	}
+}
+
+func TestApply(t *testing.T) {
+	t.Setenv("POSTGRES_HOST", "from-env")
+	t.Setenv("POSTGRES_DB", "")
+	os.Unsetenv("POSTGRES_DB")
+	Apply(map[string]string{"POSTGRES_HOST": "from-file", "POSTGRES_DB": "forex3"})
+	if got := os.Getenv("POSTGRES_HOST"); got != "from-env" {
+		t.Errorf("POSTGRES_HOST = %q, the environment should win", got)
+	}
+	if got := os.Getenv("POSTGRES_DB"); got != "forex3" {
+		t.Errorf("POSTGRES_DB = %q, want it from the file", got)
+	}
+}
+
+func TestExample(t *testing.T) {
+	f, err := Load("../maescraper.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range f.ProfileNames() {
+		if _, err := f.Settings(p); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+// Package dbconfig builds PostgreSQL connection settings for maescraper,
+// historicoforex and syncforex from environment variables or a DSN.
+// Passwords and DSNs are secrets (see package secrets); without a password
+// the one in .pgpass (or PGPASSFILE) is used, as with libpq.
+package dbconfig
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgconn/ctxwatch"
+	"github.com/jmtruffa/maescraper/secrets"
+)
+
+// Config is how to reach one database. When DSN is set it is used as is
+// (URL or key=value form, including any TLS settings) and only
+// ApplicationName and the timeouts are applied on top; otherwise the
+// connection string is built from the other fields.
+type Config struct {
+	DSN      string `json:"dsn"`
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Database string `json:"database"`
+
+	// TLS, as in libpq: sslmode is disable, allow, prefer, require,
+	// verify-ca or verify-full; the cert and key enable client certificate auth
+	SSLMode     string `json:"sslmode"`
+	SSLRootCert string `json:"sslrootcert"`
+	SSLCert     string `json:"sslcert"`
+	SSLKey      string `json:"sslkey"`
+
+	// Connection service of the pg_service.conf file (or PGSERVICEFILE),
+	// and the password file to use instead of ~/.pgpass, as in libpq
+	Service  string `json:"service"`
+	PassFile string `json:"passfile"`
+
+	ApplicationName  string `json:"applicationName"`  // defaults to the command name
+	ConnectTimeout   string `json:"connectTimeout"`   // e.g. 10s
+	StatementTimeout string `json:"statementTimeout"` // e.g. 5m, 0 disables
+
+	err error // reading the secrets, returned by ConnConfig
+}
+
+// FromEnv reads a Config from the variables with the given prefix, e.g. for
+// "POSTGRES_": POSTGRES_DSN, POSTGRES_HOST, POSTGRES_PORT, POSTGRES_USER,
+// POSTGRES_PASSWORD, POSTGRES_DB, POSTGRES_SSLMODE, POSTGRES_SSLROOTCERT,
+// POSTGRES_SSLCERT, POSTGRES_SSLKEY, POSTGRES_SERVICE, POSTGRES_PASSFILE,
+// POSTGRES_APPLICATION_NAME, POSTGRES_CONNECT_TIMEOUT and
+// POSTGRES_STATEMENT_TIMEOUT. For the local database (prefix POSTGRES_)
+// DATABASE_URL is used when POSTGRES_DSN is not set. The DSN and password
+// are read with secrets.Get, so POSTGRES_PASSWORD_FILE and the like work too.
+func FromEnv(prefix string) Config {
+	c := Config{
+		Host:             os.Getenv(prefix + "HOST"),
+		Port:             os.Getenv(prefix + "PORT"),
+		User:             os.Getenv(prefix + "USER"),
+		Database:         os.Getenv(prefix + "DB"),
+		SSLMode:          os.Getenv(prefix + "SSLMODE"),
+		SSLRootCert:      os.Getenv(prefix + "SSLROOTCERT"),
+		SSLCert:          os.Getenv(prefix + "SSLCERT"),
+		SSLKey:           os.Getenv(prefix + "SSLKEY"),
+		Service:          os.Getenv(prefix + "SERVICE"),
+		PassFile:         os.Getenv(prefix + "PASSFILE"),
+		ApplicationName:  os.Getenv(prefix + "APPLICATION_NAME"),
+		ConnectTimeout:   os.Getenv(prefix + "CONNECT_TIMEOUT"),
+		StatementTimeout: os.Getenv(prefix + "STATEMENT_TIMEOUT"),
+	}
+	c.DSN = c.secret(prefix + "DSN")
+	if c.DSN == "" && prefix == "POSTGRES_" {
+		c.DSN = c.secret("DATABASE_URL")
+	}
+	c.Password = c.secret(prefix + "PASSWORD")
+	return c
+}
+
+// WithPassword reads the password from the named secret, unless it is
+// already set.
+func (c Config) WithPassword(name string) Config {
+	if c.Password == "" && name != "" {
+		c.Password = c.secret(name)
+	}
+	return c
+}
+
+// secret reads the named secret, keeping the first error for ConnConfig.
+func (c *Config) secret(name string) string {
+	v, err := secrets.Get(name)
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	return v
+}
+
+// ConnString returns the connection string, with every part URL-escaped so
+// passwords and names may contain any character.
+func (c Config) ConnString() string {
+	if c.DSN != "" {
+		return c.DSN
+	}
+
+	u := url.URL{Scheme: "postgres", Host: c.Host, Path: "/" + c.Database}
+	if c.Port != "" {
+		u.Host = net.JoinHostPort(c.Host, c.Port)
+	}
+	switch {
+	case c.User != "" && c.Password != "":
+		u.User = url.UserPassword(c.User, c.Password)
+	case c.User != "":
+		// No password at all, so .pgpass or the service may provide one
+		u.User = url.User(c.User)
+	}
+	q := url.Values{}
+	for k, v := range map[string]string{
+		"sslmode":     c.SSLMode,
+		"sslrootcert": c.SSLRootCert,
+		"sslcert":     c.SSLCert,
+		"sslkey":      c.SSLKey,
+		"service":     c.Service,
+		"passfile":    c.PassFile,
+	} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// ConnConfig parses the settings into a pgx configuration.
+func (c Config) ConnConfig() (*pgx.ConnConfig, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	cfg, err := pgx.ParseConfig(c.ConnString())
+	if err != nil {
+		// The parse error may quote the connection string, password included
+		return nil, fmt.Errorf("invalid connection settings for %s", c.describe())
+	}
+
+	appName := c.ApplicationName
+	if appName == "" && cfg.RuntimeParams["application_name"] == "" {
+		appName = filepath.Base(os.Args[0])
+	}
+	if appName != "" {
+		cfg.RuntimeParams["application_name"] = appName
+	}
+	if c.ConnectTimeout != "" {
+		d, err := time.ParseDuration(c.ConnectTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid connect timeout '%s': %w", c.ConnectTimeout, err)
+		}
+		cfg.ConnectTimeout = d
+	}
+	if c.StatementTimeout != "" {
+		d, err := time.ParseDuration(c.StatementTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid statement timeout '%s': %w", c.StatementTimeout, err)
+		}
+		cfg.RuntimeParams["statement_timeout"] = strconv.FormatInt(d.Milliseconds(), 10)
+	}
+	// A cancelled context cancels the statement on the server instead of
+	// closing the connection, so the transaction can still be rolled back
+	cfg.BuildContextWatcherHandler = func(pgConn *pgconn.PgConn) ctxwatch.Handler {
+		return &pgconn.CancelRequestContextWatcherHandler{Conn: pgConn, DeadlineDelay: cancelGrace}
+	}
+	return cfg, nil
+}
+
+// cancelGrace is how long a cancelled statement has to stop before its
+// connection is closed.
+const cancelGrace = 10 * time.Second
+
+// Connect opens a connection with the given settings.
+func Connect(ctx context.Context, c Config) (*pgx.Conn, error) {
+	cfg, err := c.ConnConfig()
+	if err != nil {
+		return nil, err
+	}
+	return pgx.ConnectConfig(ctx, cfg)
+}
+
+// Rollback rolls tx back, for a deferred call. It does so even when ctx is
+// done, so an interrupted run ends its transactions cleanly; after Commit it
+// does nothing.
+func Rollback(ctx context.Context, tx pgx.Tx) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cancelGrace)
+	defer cancel()
+	err := tx.Rollback(ctx)
+	if err != nil && !errors.Is(err, pgx.ErrTxClosed) && !tx.Conn().IsClosed() {
+		slog.Warn("Unable to roll back transaction", "error", err)
+	}
+}
+
+// describe names the database without credentials, for error messages.
+func (c Config) describe() string {
+	if c.DSN != "" {
+		return "the configured DSN"
+	}
+	if c.Service != "" && c.Host == "" {
+		return "service " + c.Service
+	}
+	host := c.Host
+	if c.Port != "" {
+		host = net.JoinHostPort(c.Host, c.Port)
+	}
+	return fmt.Sprintf("%s@%s/%s", c.User, host, c.Database)
+}
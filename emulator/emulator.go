@@ -0,0 +1,255 @@
+// Package emulator serves the MAE forex and historicoforex endpoints from the
+// recorded responses the tests use, with optional latency and failures, so
+// the scrapers can be run end to end without the real API. It is the
+// emulator command of maescraper.
+package emulator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmtruffa/maescraper/runlog"
+)
+
+const (
+	forexPath     = "/MarketData/v1/mercado/cotizaciones/forex"
+	historicoPath = "/api/mercado/titulo/historicoforex"
+
+	// Recorded responses served by default, relative to the repository root
+	defaultForexFixture     = "testdata/forex_2024-11-15.json"
+	defaultHistoricoFixture = "historicoforex/testdata/historicoforex_2024-11-13_2024-11-15.json"
+
+	// shutdownTimeout is how long the requests in flight have to finish
+	shutdownTimeout = 5 * time.Second
+)
+
+// config holds the emulator settings, read from EMULATOR_* environment variables.
+type config struct {
+	Addr             string        // EMULATOR_ADDR, listen address
+	ForexFixture     string        // EMULATOR_FOREX_FIXTURE, response of the forex endpoint
+	HistoricoFixture string        // EMULATOR_HISTORICO_FIXTURE, date groups of the historicoforex endpoint
+	APIKey           string        // EMULATOR_API_KEY, expected x-api-key for the forex endpoint
+	Latency          time.Duration // EMULATOR_LATENCY, delay added to every response
+	Rate429          float64       // EMULATOR_RATE_429, probability of answering 429
+	Rate500          float64       // EMULATOR_RATE_500, probability of answering 500
+	RateBadJSON      float64       // EMULATOR_RATE_MALFORMED, probability of answering truncated JSON
+
+	draw func() float64 // source of the fault draws; rand.Float64 unless set by tests
+}
+
+// historicoGroup is the minimal shape needed to filter historicoforex fixtures by date.
+type historicoGroup struct {
+	Fecha string `json:"fecha"`
+}
+
+// Run serves the emulated endpoints on EMULATOR_ADDR (default :8089) until
+// ctx is cancelled. Point the scrapers at it with MAE_API_BASE_URL and
+// MAE_HISTORICO_BASE_URL, and MAE_API_KEY set to EMULATOR_API_KEY (default
+// test-key). The fixtures are read from the working directory on every
+// request, so run it from the repository root; they can be edited while it
+// runs.
+func Run(ctx context.Context) {
+	cfg, err := loadConfig()
+	if err != nil {
+		slog.Error("Invalid emulator settings", "error", err)
+		os.Exit(runlog.StatusValidation.ExitCode())
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(forexPath, cfg.withFaults(cfg.handleForex))
+	mux.HandleFunc(historicoPath, cfg.withFaults(cfg.handleHistorico))
+	srv := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	slog.Info("MAE emulator listening", "addr", cfg.Addr,
+		"forex", forexPath, "forex_fixture", cfg.ForexFixture,
+		"historicoforex", historicoPath, "historicoforex_fixture", cfg.HistoricoFixture)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-errc:
+		slog.Error("Emulator stopped", "error", err)
+		os.Exit(runlog.StatusFailed.ExitCode())
+	case <-ctx.Done():
+	}
+
+	slog.Info("Stopping emulator")
+	shutdown, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdown); err != nil {
+		slog.Warn("Emulator did not stop cleanly", "error", err)
+	}
+}
+
+func loadConfig() (config, error) {
+	cfg := config{
+		Addr:             envOrDefault("EMULATOR_ADDR", ":8089"),
+		ForexFixture:     envOrDefault("EMULATOR_FOREX_FIXTURE", defaultForexFixture),
+		HistoricoFixture: envOrDefault("EMULATOR_HISTORICO_FIXTURE", defaultHistoricoFixture),
+		APIKey:           envOrDefault("EMULATOR_API_KEY", "test-key"),
+		draw:             rand.Float64,
+	}
+	var errs []error
+	var err error
+	if cfg.Latency, err = envDuration("EMULATOR_LATENCY"); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.Rate429, err = envRate("EMULATOR_RATE_429"); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.Rate500, err = envRate("EMULATOR_RATE_500"); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.RateBadJSON, err = envRate("EMULATOR_RATE_MALFORMED"); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.Rate429+cfg.Rate500+cfg.RateBadJSON > 1 {
+		errs = append(errs, errors.New("EMULATOR_RATE_429, EMULATOR_RATE_500 and EMULATOR_RATE_MALFORMED must add up to at most 1"))
+	}
+	return cfg, errors.Join(errs...)
+}
+
+// withFaults wraps a handler with the configured latency and random failures.
+// A single draw picks at most one fault, so each rate is the probability of
+// its own fault.
+func (c config) withFaults(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slog.Info("Request", "method", r.Method, "uri", r.URL.RequestURI())
+		if c.Latency > 0 {
+			time.Sleep(c.Latency)
+		}
+		p := c.draw()
+		switch {
+		case p < c.Rate429:
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, `{"message":"Too Many Requests"}`, http.StatusTooManyRequests)
+			return
+		case p < c.Rate429+c.Rate500:
+			http.Error(w, `{"message":"Internal Server Error"}`, http.StatusInternalServerError)
+			return
+		case p < c.Rate429+c.Rate500+c.RateBadJSON:
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `[{"fecha":"2024-11-15T00:00:00","ticker":`)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleForex serves the current forex snapshot. Requires x-api-key like the real API.
+func (c config) handleForex(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("x-api-key") != c.APIKey {
+		http.Error(w, `{"message":"Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+	c.serveFixture(w, c.ForexFixture, nil)
+}
+
+// handleHistorico serves the date groups within the oTitulo date range.
+func (c config) handleHistorico(w http.ResponseWriter, r *http.Request) {
+	var oTitulo struct {
+		FechaDesde string `json:"fechaDesde"`
+		FechaHasta string `json:"fechaHasta"`
+	}
+	if err := json.Unmarshal([]byte(r.URL.Query().Get("oTitulo")), &oTitulo); err != nil {
+		http.Error(w, `{"message":"invalid oTitulo"}`, http.StatusBadRequest)
+		return
+	}
+	desde, err1 := time.Parse("2006-01-02", oTitulo.FechaDesde)
+	hasta, err2 := time.Parse("2006-01-02", oTitulo.FechaHasta)
+	if err1 != nil || err2 != nil {
+		http.Error(w, `{"message":"invalid fechaDesde/fechaHasta"}`, http.StatusBadRequest)
+		return
+	}
+
+	c.serveFixture(w, c.HistoricoFixture, func(raw []json.RawMessage) []json.RawMessage {
+		filtered := []json.RawMessage{}
+		for _, g := range raw {
+			var group historicoGroup
+			if err := json.Unmarshal(g, &group); err != nil {
+				continue
+			}
+			fecha, err := time.Parse("2006-01-02T15:04:05", group.Fecha)
+			if err != nil {
+				continue
+			}
+			if !fecha.Before(desde) && !fecha.After(hasta) {
+				filtered = append(filtered, g)
+			}
+		}
+		return filtered
+	})
+}
+
+// serveFixture reads a JSON array fixture, optionally filters its elements and writes it.
+// Fixtures are read on every request so they can be edited while the emulator runs.
+func (c config) serveFixture(w http.ResponseWriter, path string, filter func([]json.RawMessage) []json.RawMessage) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		slog.Error("Failed to read fixture", "path", path, "error", err)
+		http.Error(w, `{"message":"fixture not found"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if filter != nil {
+		var raw []json.RawMessage
+		if err := json.Unmarshal(body, &raw); err != nil {
+			slog.Error("Invalid fixture", "path", path, "error", err)
+			http.Error(w, `{"message":"invalid fixture"}`, http.StatusInternalServerError)
+			return
+		}
+		body, err = json.Marshal(filter(raw))
+		if err != nil {
+			http.Error(w, `{"message":"invalid fixture"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func envOrDefault(key, defaultVal string) string {
+	val := os.Getenv(key)
+	if val == "" {
+		return defaultVal
+	}
+	return val
+}
+
+func envDuration(key string) (time.Duration, error) {
+	val := os.Getenv(key)
+	if val == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s '%s': %w", key, val, err)
+	}
+	return d, nil
+}
+
+func envRate(key string) (float64, error) {
+	val := os.Getenv(key)
+	if val == "" {
+		return 0, nil
+	}
+	rate, err := strconv.ParseFloat(val, 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("invalid %s '%s': must be a probability between 0 and 1", key, val)
+	}
+	return rate, nil
+}
@@ -0,0 +1,165 @@
+package emulator
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+// testConfig serves the recorded responses of the repository.
+func testConfig(seed int64) config {
+	return config{
+		ForexFixture:     filepath.Join("..", defaultForexFixture),
+		HistoricoFixture: filepath.Join("..", defaultHistoricoFixture),
+		APIKey:           "test-key",
+		draw:             rand.New(rand.NewSource(seed)).Float64,
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("EMULATOR_RATE_429", "0.5")
+	t.Setenv("EMULATOR_RATE_500", "0.6")
+	if _, err := loadConfig(); err == nil {
+		t.Error("loadConfig() accepted rates adding up to more than 1")
+	}
+	t.Setenv("EMULATOR_RATE_500", "0.2")
+	t.Setenv("EMULATOR_LATENCY", "soon")
+	if _, err := loadConfig(); err == nil {
+		t.Error("loadConfig() accepted an invalid EMULATOR_LATENCY")
+	}
+}
+
+func TestHandleForexAPIKey(t *testing.T) {
+	c := testConfig(1)
+	tests := []struct {
+		key  string
+		want int
+	}{
+		{"test-key", http.StatusOK},
+		{"wrong-key", http.StatusUnauthorized},
+		{"", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, forexPath, nil)
+		if tt.key != "" {
+			req.Header.Set("x-api-key", tt.key)
+		}
+		w := httptest.NewRecorder()
+		c.handleForex(w, req)
+		if w.Code != tt.want {
+			t.Errorf("x-api-key %q: status = %d, want %d", tt.key, w.Code, tt.want)
+		}
+	}
+}
+
+func TestHandleHistoricoDateRange(t *testing.T) {
+	c := testConfig(1)
+	tests := []struct {
+		desde, hasta string
+		want         []string
+	}{
+		{"2024-11-13", "2024-11-15", []string{"2024-11-13T00:00:00", "2024-11-14T00:00:00", "2024-11-15T00:00:00"}},
+		{"2024-11-14", "2024-11-14", []string{"2024-11-14T00:00:00"}},
+		{"2024-11-15", "2024-11-20", []string{"2024-11-15T00:00:00"}},
+		{"2024-11-01", "2024-11-12", []string{}},
+	}
+	for _, tt := range tests {
+		oTitulo := `{"fechaDesde":"` + tt.desde + `","fechaHasta":"` + tt.hasta + `"}`
+		req := httptest.NewRequest(http.MethodGet, historicoPath+"?oTitulo="+url.QueryEscape(oTitulo), nil)
+		w := httptest.NewRecorder()
+		c.handleHistorico(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s..%s: status = %d, want 200", tt.desde, tt.hasta, w.Code)
+		}
+		var groups []historicoGroup
+		if err := json.Unmarshal(w.Body.Bytes(), &groups); err != nil {
+			t.Fatalf("%s..%s: %v", tt.desde, tt.hasta, err)
+		}
+		got := []string{}
+		for _, g := range groups {
+			got = append(got, g.Fecha)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s..%s: fechas = %v, want %v", tt.desde, tt.hasta, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s..%s: fechas = %v, want %v", tt.desde, tt.hasta, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestHandleHistoricoBadRange(t *testing.T) {
+	c := testConfig(1)
+	for _, q := range []string{"", "oTitulo=not-json", "oTitulo=" + url.QueryEscape(`{"fechaDesde":"13/11/2024","fechaHasta":"2024-11-15"}`)} {
+		w := httptest.NewRecorder()
+		c.handleHistorico(w, httptest.NewRequest(http.MethodGet, historicoPath+"?"+q, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("query %q: status = %d, want 400", q, w.Code)
+		}
+	}
+}
+
+// faultStatus runs one request through withFaults and classifies the response.
+func faultStatus(c config) string {
+	ok := func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(`[]`)) }
+	w := httptest.NewRecorder()
+	c.withFaults(ok)(w, httptest.NewRequest(http.MethodGet, forexPath, nil))
+	switch {
+	case w.Code == http.StatusTooManyRequests:
+		return "429"
+	case w.Code == http.StatusInternalServerError:
+		return "500"
+	case !json.Valid(w.Body.Bytes()):
+		return "malformed"
+	default:
+		return "ok"
+	}
+}
+
+func TestWithFaultsSelection(t *testing.T) {
+	c := config{Rate429: 0.1, Rate500: 0.2, RateBadJSON: 0.3}
+	tests := []struct {
+		draw float64
+		want string
+	}{
+		{0, "429"},
+		{0.09, "429"},
+		{0.1, "500"},
+		{0.29, "500"},
+		{0.31, "malformed"},
+		{0.59, "malformed"},
+		{0.61, "ok"},
+		{0.99, "ok"},
+	}
+	for _, tt := range tests {
+		c.draw = func() float64 { return tt.draw }
+		if got := faultStatus(c); got != tt.want {
+			t.Errorf("draw %v: got %s, want %s", tt.draw, got, tt.want)
+		}
+	}
+}
+
+// Each rate is the share of its own fault, not reduced by the faults checked before it.
+func TestWithFaultsRates(t *testing.T) {
+	c := testConfig(42)
+	c.Rate429, c.Rate500, c.RateBadJSON = 0.2, 0.2, 0.2
+
+	const n = 5000
+	counts := map[string]int{}
+	for range n {
+		counts[faultStatus(c)]++
+	}
+	for _, fault := range []string{"429", "500", "malformed"} {
+		if share := float64(counts[fault]) / n; share < 0.17 || share > 0.23 {
+			t.Errorf("%s share = %.3f, want about 0.2", fault, share)
+		}
+	}
+}
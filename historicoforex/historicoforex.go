@@ -0,0 +1,477 @@
+// Package historicoforex loads the dates missing from public.forex from the
+// MAE historicoforex endpoint. It is the backfill command of maescraper.
+package historicoforex
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jmtruffa/maescraper/dbconfig"
+	"github.com/jmtruffa/maescraper/internal/forex"
+	"github.com/jmtruffa/maescraper/lock"
+	"github.com/jmtruffa/maescraper/logging"
+	"github.com/jmtruffa/maescraper/metrics"
+	"github.com/jmtruffa/maescraper/runlog"
+)
+
+const (
+	defaultAPIBaseURL = "https://api.marketdata.mae.com.ar"
+	historicoPath     = "/api/mercado/titulo/historicoforex"
+)
+
+// historicoURL returns the historicoforex endpoint URL. MAE_HISTORICO_BASE_URL
+// overrides the host, e.g. to point the scraper at the local emulator.
+func historicoURL() string {
+	baseURL := os.Getenv("MAE_HISTORICO_BASE_URL")
+	if baseURL == "" {
+		baseURL = defaultAPIBaseURL
+	}
+	return strings.TrimSuffix(baseURL, "/") + historicoPath
+}
+
+// HistoricoResponse represents a date group in the API response
+type HistoricoResponse struct {
+	Fecha   string        `json:"fecha"`
+	Volumen float64       `json:"volumen"`
+	Details []ForexDetail `json:"details"`
+}
+
+// ForexDetail represents a single record within a date group
+type ForexDetail struct {
+	Fecha            string  `json:"fecha"`
+	Ticker           string  `json:"ticker"`
+	Descripcion      string  `json:"descripcion"`
+	Moneda           string  `json:"moneda"`
+	Plazo            string  `json:"plazo"`
+	CodigoPlazo      string  `json:"codigoPlazo"`
+	Segmento         string  `json:"segmento"`
+	CodigoSegmento   string  `json:"codigoSegmento"`
+	Volumen          float64 `json:"volumen"`
+	Monto            float64 `json:"monto"`
+	Minimo           float64 `json:"minimo"`
+	Maximo           float64 `json:"maximo"`
+	Ultimo           float64 `json:"ultimo"`
+	Variacion        float64 `json:"variacion"`
+	TipoEmision      string  `json:"tipoEmision"`
+	PrecioCierre     float64 `json:"precioCierre"`
+	FechaLiquidacion string  `json:"fechaLiquidacion"`
+	UltimaTasa       float64 `json:"ultimaTasa"`
+	CierreAnterior   float64 `json:"cierreAnterior"`
+	OpenInterest     int     `json:"openInterest"`
+
+	// Extra holds fields returned by the API that are not mapped above,
+	// including unknown fields of the enclosing date group under "group"
+	Extra map[string]json.RawMessage `json:"-"`
+
+	// Missing lists the prices the record lacks or has with another type
+	Missing []string `json:"-"`
+}
+
+// Expected shape of the date groups and of each detail record
+var (
+	historicoSchema = forex.ExpectedSchema(HistoricoResponse{})
+	detailSchema    = forex.ExpectedSchema(ForexDetail{})
+)
+
+// detailPrices are the fields a detail record cannot be loaded without.
+var detailPrices = []string{"precioCierre", "ultimo", "cierreAnterior", "minimo", "maximo"}
+
+// Quote maps the record to the terms shared with the forex endpoint.
+func (d ForexDetail) Quote() forex.Quote {
+	return forex.Quote{
+		Fecha:                d.Fecha,
+		Ticker:               d.Ticker,
+		Descripcion:          d.Descripcion,
+		TipoEmision:          d.TipoEmision,
+		Segmento:             d.Segmento,
+		CodigoSegmento:       d.CodigoSegmento,
+		Plazo:                d.Plazo,
+		CodigoPlazo:          d.CodigoPlazo,
+		Moneda:               d.Moneda,
+		FechaLiquidacion:     d.FechaLiquidacion,
+		Monto:                d.Volumen,
+		Cotizacion:           d.PrecioCierre,
+		MontoAcumulado:       d.Monto,
+		PrecioUltimo:         d.Ultimo,
+		UltimaTasa:           d.UltimaTasa,
+		PrecioCierreAnterior: d.CierreAnterior,
+		PrecioMinimo:         d.Minimo,
+		PrecioMaximo:         d.Maximo,
+		OpenInterest:         d.OpenInterest,
+		Variacion:            d.Variacion,
+		Extra:                d.Extra,
+		Missing:              d.Missing,
+	}
+}
+
+// Run loads every date from the day after the newest one in public.forex up
+// to today, then exits. When ctx is cancelled it rolls back the date being
+// inserted and stops; the next run retries that date.
+//
+// Logs go to stderr through log/slog (see logging.Setup); a summary of the
+// run is printed to stdout at the end. The exit code tells the outcome, see
+// runlog.Status.ExitCode.
+func Run(ctx context.Context) {
+	// Recorded in public.ingest_runs when Run returns
+	run := runlog.Start(ctx, "historicoforex")
+	logging.Setup(run.Command, run.RunID)
+	slog.Info("Iniciando historicoForex", "version", run.Version)
+	defer run.Exit()
+
+	// Connect to PostgreSQL
+	conn := connectDB(ctx, run)
+	defer conn.Close(context.Background())
+
+	// Keep an overlapping backfill or fetch from loading the same dates
+	l, err := lock.Acquire(ctx, conn, lock.Forex, run)
+	if lock.Held(err) {
+		slog.Warn("Skipping run", "error", err)
+		run.Skip(err)
+		return
+	}
+	if err != nil {
+		run.Fatalf(runlog.StatusDatabase, "Unable to take lock: %v", err)
+	}
+	defer l.Release(context.Background())
+
+	// Get last date in forex table
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	lastDate := getLastDate(ctx, conn)
+
+	lastDateStr := lastDate.Format("2006-01-02")
+	todayStr := today.Format("2006-01-02")
+
+	slog.Info("Checked last date", "last_date", lastDateStr, "today", todayStr)
+
+	if lastDateStr >= todayStr {
+		slog.Info("Database is up to date. Nothing to do.")
+		return
+	}
+
+	// Calculate date range: lastDate + 1 day to today
+	var fechaDesde time.Time
+	if lastDate.IsZero() {
+		fechaDesde = today
+	} else {
+		fechaDesde = lastDate.AddDate(0, 0, 1)
+	}
+	fechaHasta := today
+
+	if fechaDesde.After(fechaHasta) {
+		slog.Info("No date range to fetch. Nothing to do.")
+		return
+	}
+
+	slog.Info("Fetching data", "from", fechaDesde.Format("2006-01-02"), "to", fechaHasta.Format("2006-01-02"))
+	run.SetRange(fechaDesde, fechaHasta)
+
+	// Fetch data from API
+	data := fetchHistoricoForex(ctx, fechaDesde, fechaHasta, run)
+	if data == nil {
+		slog.Error("Data fetching failed")
+		return
+	}
+
+	// Count total details
+	totalDetails := 0
+	for _, day := range data {
+		totalDetails += len(day.Details)
+	}
+	slog.Info("Received records from API", "days", len(data), "records", totalDetails)
+	run.Add(totalDetails, 0, 0, 0)
+
+	if totalDetails == 0 {
+		slog.Info("No new data to insert")
+		run.NoData()
+		return
+	}
+
+	// Insert into database
+	inserted := insertData(ctx, conn, data, run)
+
+	// Keep the instrument master up to date
+	var quotes []forex.Quote
+	for _, day := range data {
+		for _, d := range day.Details {
+			quotes = append(quotes, d.Quote())
+		}
+	}
+	forex.UpdateInstruments(ctx, conn, forex.Observations(quotes))
+
+	slog.Info("Inserted rows into forex table", "rows", inserted)
+}
+
+// connectDB connects with POSTGRES_* or DATABASE_URL, see dbconfig.FromEnv.
+func connectDB(ctx context.Context, run *runlog.Run) *pgx.Conn {
+	conn, err := dbconfig.Connect(ctx, dbconfig.FromEnv("POSTGRES_"))
+	if err != nil {
+		run.Fatalf(runlog.StatusDatabase, "Unable to connect to database: %v", err)
+	}
+	slog.Info("Connected to database")
+	return conn
+}
+
+func getLastDate(ctx context.Context, conn *pgx.Conn) time.Time {
+	var lastDate time.Time
+	err := conn.QueryRow(ctx, "SELECT COALESCE(MAX(date), '1900-01-01') FROM public.forex").Scan(&lastDate)
+	if err != nil {
+		slog.Error("Failed to query last date", "error", err)
+		return time.Time{}
+	}
+	return lastDate
+}
+
+// fetchHistoricoForex returns the date groups between desde and hasta, or nil
+// when they cannot be fetched. The response status and any error go into run.
+func fetchHistoricoForex(ctx context.Context, desde, hasta time.Time, run *runlog.Run) []HistoricoResponse {
+	oTitulo := fmt.Sprintf(`{"fechaDesde":"%s","fechaHasta":"%s"}`,
+		desde.Format("2006-01-02"),
+		hasta.Format("2006-01-02"),
+	)
+
+	apiURL := fmt.Sprintf("%s?oTitulo=%s", historicoURL(), url.QueryEscape(oTitulo))
+
+	req, err := http.NewRequestWithContext(ctx, "GET", apiURL, nil)
+	if err != nil {
+		slog.Error("Failed to create request", "error", err)
+		run.Failf(runlog.StatusSource, "create request: %v", err)
+		return nil
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; MAEScraper/1.0)")
+
+	client := &http.Client{Timeout: 60 * time.Second}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		metrics.ObserveAPI("historicoforex", 0, time.Since(start))
+		slog.Error("Failed to fetch data from API", "error", err)
+		run.Failf(runlog.StatusSource, "fetch data from API: %v", err)
+		return nil
+	}
+	defer resp.Body.Close()
+	metrics.ObserveAPI("historicoforex", resp.StatusCode, time.Since(start))
+	run.SetHTTPStatus(resp.StatusCode)
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		slog.Error("API returned an error", "status", resp.StatusCode, "body", string(body))
+		run.Failf(runlog.StatusSource, "API returned status %d", resp.StatusCode)
+		return nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		slog.Error("Failed to read response body", "error", err)
+		run.Failf(runlog.StatusSource, "read response body: %v", err)
+		return nil
+	}
+
+	// Check the schema on the raw records before decoding, so type changes are reported
+	groups, groupDetails, ok := checkHistoricoSchema(body)
+	if !ok {
+		run.Failf(runlog.StatusValidation, "invalid or changed API response")
+		return nil
+	}
+
+	data, err := decodeHistorico(groups, groupDetails)
+	if err != nil {
+		slog.Error("Failed to decode JSON", "error", err)
+		run.Failf(runlog.StatusValidation, "decode JSON: %v", err)
+		return nil
+	}
+	attachExtraFields(data, groups, groupDetails)
+
+	return data
+}
+
+// checkHistoricoSchema compares the date groups and their details against the
+// expected schema. Returns the raw groups and details, and false when the body
+// can't be decoded or drift was found and MAE_SCHEMA_STRICT is set.
+func checkHistoricoSchema(body []byte) ([]map[string]json.RawMessage, [][]map[string]json.RawMessage, bool) {
+	var groups []map[string]json.RawMessage
+	if err := json.Unmarshal(body, &groups); err != nil {
+		slog.Error("Failed to decode JSON", "error", err)
+		return nil, nil, false
+	}
+
+	var allDetails []map[string]json.RawMessage
+	groupDetails := make([][]map[string]json.RawMessage, len(groups))
+	for i, g := range groups {
+		if raw, ok := g["details"]; ok && forex.JSONKind(raw) == "array" {
+			if err := json.Unmarshal(raw, &groupDetails[i]); err != nil {
+				slog.Error("Failed to decode JSON details", "error", err)
+				return nil, nil, false
+			}
+			allDetails = append(allDetails, groupDetails[i]...)
+		}
+	}
+
+	groupDrift := forex.DetectDrift(groups, historicoSchema)
+	detailDrift := forex.DetectDrift(allDetails, detailSchema)
+	if !groupDrift.Empty() {
+		groupDrift.Report("historicoforex (date groups)")
+	}
+	if !detailDrift.Empty() {
+		detailDrift.Report("historicoforex (details)")
+	}
+	if (!groupDrift.Empty() || !detailDrift.Empty()) && forex.SchemaStrict() {
+		slog.Error("Aborting: MAE_SCHEMA_STRICT is set and the API schema changed")
+		return nil, nil, false
+	}
+	return groups, groupDetails, true
+}
+
+// decodeHistorico decodes the raw date groups and their details. Fields whose
+// type changed are left at their zero value; checkHistoricoSchema reports them
+// and a detail missing a price for that reason is rejected by BuildRow.
+func decodeHistorico(groups []map[string]json.RawMessage, groupDetails [][]map[string]json.RawMessage) ([]HistoricoResponse, error) {
+	data := make([]HistoricoResponse, len(groups))
+	for i, g := range groups {
+		// Details are decoded one by one below
+		group := maps.Clone(g)
+		delete(group, "details")
+		if err := forex.DecodeRecord(group, historicoSchema, &data[i]); err != nil {
+			return nil, err
+		}
+		data[i].Details = make([]ForexDetail, len(groupDetails[i]))
+		for j, d := range groupDetails[i] {
+			if err := forex.DecodeRecord(d, detailSchema, &data[i].Details[j]); err != nil {
+				return nil, err
+			}
+			data[i].Details[j].Missing = forex.MissingFields(d, detailSchema, detailPrices...)
+		}
+	}
+	return data, nil
+}
+
+// attachExtraFields stores the unknown fields of each detail, and those of its
+// date group under "group", in the detail's Extra.
+func attachExtraFields(data []HistoricoResponse, groups []map[string]json.RawMessage, groupDetails [][]map[string]json.RawMessage) {
+	for i := range data {
+		groupExtra := forex.ExtraFieldsJSON(forex.UnknownFields(groups[i], historicoSchema))
+		for j := range data[i].Details {
+			extra := forex.UnknownFields(groupDetails[i][j], detailSchema)
+			if groupExtra != nil {
+				if extra == nil {
+					extra = make(map[string]json.RawMessage)
+				}
+				extra["group"] = groupExtra
+			}
+			data[i].Details[j].Extra = extra
+		}
+	}
+}
+
+// recordAttrs are the log fields identifying an API record.
+func recordAttrs(d ForexDetail, err error) []any {
+	return []any{"date", d.Fecha, "ticker", d.Ticker, "plazo", d.Plazo, "segmento", d.Segmento, "error", err}
+}
+
+// rejection describes a record that failed validation, for alerts.
+func rejection(d ForexDetail, err error) string {
+	return fmt.Sprintf("%s %s %s: %v", d.Fecha, d.Ticker, d.Plazo, err)
+}
+
+// insertData inserts the records and returns how many were inserted. Row
+// counts and failures go into run. Each date is inserted in its own
+// transaction; once ctx is cancelled the date being inserted is rolled back
+// and no further date is started, so the next run, which loads the dates
+// after the newest in the table, retries it.
+func insertData(ctx context.Context, conn *pgx.Conn, data []HistoricoResponse, run *runlog.Run) int {
+	_, err := conn.Prepare(ctx, "insert_forex", forex.InsertQuery)
+	if err != nil {
+		slog.Error("Failed to prepare statement", "error", err)
+		run.Failf(runlog.StatusDatabase, "prepare statement: %v", err)
+		return 0
+	}
+
+	inserted, failed := 0, 0
+	for _, day := range data {
+		if ctx.Err() != nil {
+			slog.Warn("Interrupted, the remaining dates are left for the next run", "next_date", day.Fecha)
+			break
+		}
+		// A date that committed counts even if ctx was cancelled right after
+		dayInserted, dayFailed, err := insertDay(ctx, conn, day, run)
+		if err != nil && ctx.Err() != nil {
+			slog.Warn("Interrupted, the remaining dates are left for the next run", "next_date", day.Fecha)
+			break
+		}
+		if err != nil {
+			slog.Error("Failed to insert date", "date", day.Fecha, "error", err)
+			run.Failf(runlog.StatusDatabase, "insert %s: %v", day.Fecha, err)
+			break
+		}
+		inserted += dayInserted
+		failed += dayFailed
+		run.Completed("%s: %d filas insertadas", day.Fecha, dayInserted)
+	}
+
+	// Failed rows are weighed against MAE_FAILURE_THRESHOLD when the run ends
+	run.Add(0, inserted, 0, failed)
+	return inserted
+}
+
+// insertDay inserts the records of one date in a transaction and returns how
+// many were inserted and how many failed. A failed row is rolled back to its
+// savepoint so the rest of the date still goes in. On error, including ctx
+// being cancelled, nothing of the date is kept.
+func insertDay(ctx context.Context, conn *pgx.Conn, day HistoricoResponse, run *runlog.Run) (int, int, error) {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer dbconfig.Rollback(ctx, tx)
+
+	inserted, failed := 0, 0
+	for _, d := range day.Details {
+		row, err := forex.BuildRow(d.Quote())
+		if err != nil {
+			slog.Warn("Skipping record", recordAttrs(d, err)...)
+			run.Reject(rejection(d, err))
+			continue
+		}
+
+		start := time.Now()
+		err = insertRow(ctx, tx, row)
+		metrics.ObserveDBWrite("historicoforex", "insert", start)
+		if ctx.Err() != nil {
+			return 0, 0, ctx.Err()
+		}
+		if err != nil {
+			slog.Error("Failed to insert row", recordAttrs(d, err)...)
+			failed++
+		} else {
+			inserted++
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, 0, err
+	}
+	return inserted, failed, nil
+}
+
+// insertRow inserts a row under a savepoint of tx.
+func insertRow(ctx context.Context, tx pgx.Tx, row forex.Row) error {
+	sp, err := tx.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := sp.Exec(ctx, "insert_forex", row.Values()...); err != nil {
+		dbconfig.Rollback(ctx, sp)
+		return err
+	}
+	return sp.Commit(ctx)
+}
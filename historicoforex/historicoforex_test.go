@@ -0,0 +1,160 @@
+package historicoforex
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jmtruffa/maescraper/internal/forex"
+	"github.com/jmtruffa/maescraper/internal/forextest"
+)
+
+var (
+	desde = time.Date(2024, 11, 13, 0, 0, 0, 0, time.UTC)
+	hasta = time.Date(2024, 11, 15, 0, 0, 0, 0, time.UTC)
+)
+
+// serveFixture starts a fake historicoforex endpoint that answers with the given status and body.
+func serveFixture(t *testing.T, status int, body []byte) {
+	t.Helper()
+	forextest.Serve(t, "MAE_HISTORICO_BASE_URL", status, body, func(r *http.Request) {
+		if r.URL.Path != historicoPath {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		want := `{"fechaDesde":"2024-11-13","fechaHasta":"2024-11-15"}`
+		if got := r.URL.Query().Get("oTitulo"); got != want {
+			t.Errorf("oTitulo = %s, want %s", got, want)
+		}
+	})
+}
+
+// fixtureRows fetches a recorded response and builds its rows.
+func fixtureRows(t *testing.T, fixture string) []forex.Row {
+	t.Helper()
+	serveFixture(t, http.StatusOK, forextest.ReadFixture(t, fixture))
+	data := fetchHistoricoForex(t.Context(), desde, hasta, nil)
+	if data == nil {
+		t.Fatal("fetchHistoricoForex returned nil")
+	}
+	var rows []forex.Row
+	for _, day := range data {
+		for _, d := range day.Details {
+			row, err := forex.BuildRow(d.Quote())
+			if err != nil {
+				t.Fatalf("BuildRow(%s): %v", d.Ticker, err)
+			}
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// TestFixtureRows fetches each recorded response and compares the rows it
+// produces with testdata/<fixture>.rows.json. Run with -update to regenerate.
+func TestFixtureRows(t *testing.T) {
+	for _, fixture := range []string{"historicoforex_2024-11-13_2024-11-15.json", "historicoforex_drift.json"} {
+		t.Run(fixture, func(t *testing.T) {
+			forextest.CheckRows(t, fixture, fixtureRows(t, fixture))
+		})
+	}
+}
+
+// TestFixtureMapping pins down what the records of the first day map to:
+// monto is volumen, monto_acumulado monto, cotizacion precioCierre and the
+// prices ultimo, cierreAnterior, minimo and maximo.
+func TestFixtureMapping(t *testing.T) {
+	want := []forextest.Mapping{
+		{Date: "2024-11-13", Rueda: "CAM1", Instrumento: "USB / ART 000", CurrencyOut: "USB", CurrencyIn: "ART",
+			Settle: "0", SettleDate: "2024-11-13",
+			Monto: 11800000, Cotizacion: 993.5, MontoAcumulado: 11723300000,
+			PrecioUltimo: 993.5, PrecioCierreAnterior: 992, PrecioMinimo: 991.5, PrecioMaximo: 994,
+			ISOCurrencyOut: "USD", ISOCurrencyIn: "ARS", SettlementType: "billete"},
+		{Date: "2024-11-13", Rueda: "CAM1", Instrumento: "USB / ART 001", CurrencyOut: "USB", CurrencyIn: "ART",
+			Settle: "1", SettleDate: "2024-11-14",
+			Monto: 45100000, Cotizacion: 994.75, MontoAcumulado: 44863225000,
+			PrecioUltimo: 994.75, PrecioCierreAnterior: 993.25, PrecioMinimo: 992.5, PrecioMaximo: 995.5,
+			ISOCurrencyOut: "USD", ISOCurrencyIn: "ARS", SettlementType: "billete"},
+		// No fechaLiquidacion ("0001-01-01T00:00:00") is NULL
+		{Date: "2024-11-13", Rueda: "CAM2", Instrumento: "USMEP / ART 000", CurrencyOut: "USMEP", CurrencyIn: "ART",
+			Settle: "0",
+			Monto:  790000, Cotizacion: 1156.5, MontoAcumulado: 913635000,
+			PrecioUltimo: 1156.5, PrecioCierreAnterior: 1155, PrecioMinimo: 1151.5, PrecioMaximo: 1159.5,
+			ISOCurrencyOut: "USD", ISOCurrencyIn: "ARS", SettlementType: "MEP"},
+	}
+
+	rows := fixtureRows(t, "historicoforex_2024-11-13_2024-11-15.json")
+	if len(rows) != 9 {
+		t.Fatalf("%d rows, want 3 for each of 3 days", len(rows))
+	}
+	for i, w := range want {
+		if got := forextest.MappingOf(rows[i]); got != w {
+			t.Errorf("row %d:\n got %+v\nwant %+v", i, got, w)
+		}
+	}
+}
+
+func TestFetchHistoricoForexErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{"server error", http.StatusInternalServerError, `{"message":"Internal Server Error"}`},
+		{"rate limited", http.StatusTooManyRequests, `{"message":"Too Many Requests"}`},
+		{"malformed json", http.StatusOK, `[{"fecha":"2024-11-15T00:00:00","details":`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serveFixture(t, tt.status, []byte(tt.body))
+			if data := fetchHistoricoForex(t.Context(), desde, hasta, nil); data != nil {
+				t.Errorf("fetchHistoricoForex() = %d days, want nil", len(data))
+			}
+		})
+	}
+}
+
+func TestFetchHistoricoForexEmpty(t *testing.T) {
+	serveFixture(t, http.StatusOK, []byte(`[]`))
+	data := fetchHistoricoForex(t.Context(), desde, hasta, nil)
+	if data == nil || len(data) != 0 {
+		t.Errorf("fetchHistoricoForex() = %v, want an empty, non-nil result", data)
+	}
+}
+
+func TestFetchHistoricoForexStrictSchema(t *testing.T) {
+	serveFixture(t, http.StatusOK, forextest.ReadFixture(t, "historicoforex_drift.json"))
+	t.Setenv("MAE_SCHEMA_STRICT", "true")
+	if data := fetchHistoricoForex(t.Context(), desde, hasta, nil); data != nil {
+		t.Errorf("fetchHistoricoForex() = %d days, want nil with MAE_SCHEMA_STRICT", len(data))
+	}
+}
+
+// Fields whose type changed are reported as drift and kept in extra_fields;
+// the rest of the response is still loaded unless MAE_SCHEMA_STRICT is set.
+func TestFetchHistoricoForexTypeChanged(t *testing.T) {
+	body := []byte(`[{"fecha":"2024-11-15T00:00:00","volumen":"1","details":[{"fecha":"2024-11-15T00:00:00","ticker":"USB$T","monto":"10","ultimo":995.5}]}]`)
+	serveFixture(t, http.StatusOK, body)
+	data := fetchHistoricoForex(t.Context(), desde, hasta, nil)
+	if len(data) != 1 || len(data[0].Details) != 1 {
+		t.Fatalf("fetchHistoricoForex() = %v, want one day with one detail", data)
+	}
+	d := data[0].Details[0]
+	if d.Ticker != "USB$T" || d.Monto != 0 || d.Ultimo != 995.5 {
+		t.Errorf("detail = %+v, want ticker USB$T, monto 0, ultimo 995.5", d)
+	}
+	if got := string(d.Extra["monto"]); got != `"10"` {
+		t.Errorf("Extra[monto] = %s, want \"10\"", got)
+	}
+	if got := string(d.Extra["group"]); got != `{"volumen":"1"}` {
+		t.Errorf("Extra[group] = %s, want {\"volumen\":\"1\"}", got)
+	}
+	if want := []string{"precioCierre", "cierreAnterior", "minimo", "maximo"}; !slices.Equal(d.Missing, want) {
+		t.Errorf("Missing = %v, want %v", d.Missing, want)
+	}
+
+	t.Setenv("MAE_SCHEMA_STRICT", "true")
+	if data := fetchHistoricoForex(t.Context(), desde, hasta, nil); data != nil {
+		t.Errorf("fetchHistoricoForex() = %d days, want nil with MAE_SCHEMA_STRICT", len(data))
+	}
+}
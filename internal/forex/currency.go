@@ -0,0 +1,72 @@
+package forex
+
+import (
+	"log/slog"
+)
+
+// Settlement types stored in forex.settlement_type
+const (
+	settlementCable         = "cable"
+	settlementMEP           = "MEP"
+	settlementBillete       = "billete"
+	settlementTransferencia = "transferencia"
+)
+
+// currencyMapping describes how a legacy MAE currency code translates to
+// an ISO 4217 currency and the settlement type it trades with.
+type currencyMapping struct {
+	ISO            string
+	SettlementType string
+}
+
+// currencyOutMappings maps the legacy currency_out code (ticker without "$T")
+// to its ISO currency and settlement type. Keep in sync with the backfill in
+// sql/001.
+var currencyOutMappings = map[string]currencyMapping{
+	"USB":   {ISO: "USD", SettlementType: settlementBillete},
+	"MB":    {ISO: "USD", SettlementType: settlementTransferencia},
+	"USMEP": {ISO: "USD", SettlementType: settlementMEP},
+	"UBMEP": {ISO: "USD", SettlementType: settlementMEP},
+}
+
+// currencyInMappings maps the moneda field to the ISO currency of the quote side.
+// "T" (pesos transferencia) -> "ARS"
+var currencyInMappings = map[string]string{
+	"T": "ARS",
+}
+
+// unmappedCurrencies remembers which codes were already reported so each
+// missing mapping is logged only once per run.
+var unmappedCurrencies = map[string]bool{}
+
+// deriveISOCurrencyOut returns the ISO currency and settlement type for a
+// legacy currency_out code. Unmapped codes return nil so the columns are
+// stored as NULL.
+func deriveISOCurrencyOut(currencyOut string) (iso, settlementType *string) {
+	m, ok := currencyOutMappings[currencyOut]
+	if !ok {
+		reportUnmappedCurrency("currency_out", currencyOut)
+		return nil, nil
+	}
+	return &m.ISO, &m.SettlementType
+}
+
+// deriveISOCurrencyIn returns the ISO currency for the moneda field, or nil
+// when the code is not mapped.
+func deriveISOCurrencyIn(moneda string) *string {
+	iso, ok := currencyInMappings[moneda]
+	if !ok {
+		reportUnmappedCurrency("moneda", moneda)
+		return nil
+	}
+	return &iso
+}
+
+func reportUnmappedCurrency(field, code string) {
+	key := field + ":" + code
+	if unmappedCurrencies[key] {
+		return
+	}
+	unmappedCurrencies[key] = true
+	slog.Warn("No ISO currency mapping, storing NULL ISO columns", "field", field, "code", code)
+}
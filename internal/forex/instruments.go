@@ -0,0 +1,255 @@
+package forex
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jmtruffa/maescraper/dbconfig"
+)
+
+const (
+	// instrumentsChannel is the PostgreSQL NOTIFY channel used to announce
+	// new, changed, stale and reactivated instruments.
+	instrumentsChannel = "forex_instruments"
+
+	// defaultInstrumentStaleDays is how many days a ticker may go without
+	// trading before it is marked inactive. Override with MAE_INSTRUMENT_STALE_DAYS.
+	defaultInstrumentStaleDays = 7
+)
+
+// Observation is the ticker metadata seen on a given trading date.
+type Observation struct {
+	Date           time.Time
+	Ticker         string
+	CodigoSegmento string
+	Segmento       string
+	Descripcion    string
+	TipoEmision    string
+	Moneda         string
+}
+
+// sameAttributes reports whether two observations carry the same metadata.
+func (o Observation) sameAttributes(other Observation) bool {
+	return o.Segmento == other.Segmento &&
+		o.Descripcion == other.Descripcion &&
+		o.TipoEmision == other.TipoEmision &&
+		o.Moneda == other.Moneda
+}
+
+// instrumentEvent is the payload sent on instrumentsChannel.
+type instrumentEvent struct {
+	Event          string `json:"event"`
+	Ticker         string `json:"ticker"`
+	CodigoSegmento string `json:"codigoSegmento"`
+	Date           string `json:"date"`
+}
+
+// Observations extracts the ticker metadata from the quotes.
+func Observations(quotes []Quote) []Observation {
+	var obs []Observation
+	for _, q := range quotes {
+		fecha, err := time.Parse("2006-01-02T15:04:05", q.Fecha)
+		if err != nil {
+			continue
+		}
+		obs = append(obs, Observation{
+			Date:           fecha,
+			Ticker:         q.Ticker,
+			CodigoSegmento: q.CodigoSegmento,
+			Segmento:       q.Segmento,
+			Descripcion:    q.Descripcion,
+			TipoEmision:    q.TipoEmision,
+			Moneda:         q.Moneda,
+		})
+	}
+	return obs
+}
+
+// UpdateInstruments maintains forex_instruments and its history from the
+// observed tickers. Metadata changes close the current history version and
+// open a new one; tickers that have not traded for the configured number of
+// days are marked inactive. All events are logged and sent via pg_notify.
+func UpdateInstruments(ctx context.Context, conn *pgx.Conn, obs []Observation) {
+	if len(obs) == 0 {
+		return
+	}
+
+	// Process in date order so changes are recorded in the order they happened
+	sort.SliceStable(obs, func(i, j int) bool { return obs[i].Date.Before(obs[j].Date) })
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		slog.Error("Failed to start instruments transaction", "error", err)
+		return
+	}
+	defer dbconfig.Rollback(ctx, tx)
+
+	seen := map[string]bool{}
+	for _, o := range obs {
+		// One observation per ticker and day is enough
+		key := o.Ticker + "|" + o.CodigoSegmento + "|" + o.Date.Format("2006-01-02")
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		if err := observeInstrument(ctx, tx, o); err != nil {
+			slog.Error("Failed to update instrument", "ticker", o.Ticker, "segmento", o.CodigoSegmento, "error", err)
+			return
+		}
+	}
+
+	// Mark instruments that stopped trading
+	latest := obs[len(obs)-1].Date
+	cutoff := latest.AddDate(0, 0, -instrumentStaleDays())
+	rows, err := tx.Query(ctx, `
+		UPDATE public.forex_instruments
+		SET active = false, updated_at = now()
+		WHERE active AND last_seen < $1
+		RETURNING ticker, codigo_segmento, last_seen`, cutoff)
+	if err != nil {
+		slog.Error("Failed to mark stale instruments", "error", err)
+		return
+	}
+	var stale []instrumentEvent
+	for rows.Next() {
+		var ticker, codigoSegmento string
+		var lastSeen time.Time
+		if err := rows.Scan(&ticker, &codigoSegmento, &lastSeen); err != nil {
+			rows.Close()
+			slog.Error("Failed to scan stale instrument", "error", err)
+			return
+		}
+		stale = append(stale, instrumentEvent{"stopped", ticker, codigoSegmento, lastSeen.Format("2006-01-02")})
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		slog.Error("Failed to mark stale instruments", "error", rows.Err())
+		return
+	}
+	for _, e := range stale {
+		if err := notifyInstrument(ctx, tx, e); err != nil {
+			slog.Error("Failed to notify stale instrument", "error", err)
+			return
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		slog.Error("Failed to commit instruments", "error", err)
+	}
+}
+
+// observeInstrument applies a single observation to the master table.
+func observeInstrument(ctx context.Context, tx pgx.Tx, o Observation) error {
+	var (
+		current             Observation
+		firstSeen, lastSeen time.Time
+		active              bool
+	)
+	err := tx.QueryRow(ctx, `
+		SELECT COALESCE(segmento, ''), COALESCE(descripcion, ''), COALESCE(tipo_emision, ''),
+		       COALESCE(moneda, ''), first_seen, last_seen, active
+		FROM public.forex_instruments
+		WHERE ticker = $1 AND codigo_segmento = $2
+		FOR UPDATE`, o.Ticker, o.CodigoSegmento).Scan(
+		&current.Segmento, &current.Descripcion, &current.TipoEmision,
+		&current.Moneda, &firstSeen, &lastSeen, &active,
+	)
+
+	if err == pgx.ErrNoRows {
+		// Brand-new ticker
+		_, err = tx.Exec(ctx, `
+			INSERT INTO public.forex_instruments (
+				ticker, codigo_segmento, segmento, descripcion, tipo_emision, moneda, first_seen, last_seen
+			) VALUES ($1, $2, $3, $4, $5, $6, $7, $7)`,
+			o.Ticker, o.CodigoSegmento, o.Segmento, o.Descripcion, o.TipoEmision, o.Moneda, o.Date)
+		if err != nil {
+			return err
+		}
+		if err := insertInstrumentVersion(ctx, tx, o); err != nil {
+			return err
+		}
+		return notifyInstrument(ctx, tx, instrumentEvent{"new", o.Ticker, o.CodigoSegmento, o.Date.Format("2006-01-02")})
+	}
+	if err != nil {
+		return err
+	}
+
+	// Older observations (e.g. a backfill) only extend first_seen
+	if o.Date.Before(lastSeen) {
+		if o.Date.Before(firstSeen) {
+			_, err = tx.Exec(ctx, `
+				UPDATE public.forex_instruments SET first_seen = $3, updated_at = now()
+				WHERE ticker = $1 AND codigo_segmento = $2`, o.Ticker, o.CodigoSegmento, o.Date)
+		}
+		return err
+	}
+
+	if !o.sameAttributes(current) {
+		_, err = tx.Exec(ctx, `
+			UPDATE public.forex_instruments_history SET valid_to = $3
+			WHERE ticker = $1 AND codigo_segmento = $2 AND valid_to IS NULL`,
+			o.Ticker, o.CodigoSegmento, o.Date)
+		if err != nil {
+			return err
+		}
+		if err := insertInstrumentVersion(ctx, tx, o); err != nil {
+			return err
+		}
+		if err := notifyInstrument(ctx, tx, instrumentEvent{"changed", o.Ticker, o.CodigoSegmento, o.Date.Format("2006-01-02")}); err != nil {
+			return err
+		}
+	}
+
+	if !active {
+		if err := notifyInstrument(ctx, tx, instrumentEvent{"reactivated", o.Ticker, o.CodigoSegmento, o.Date.Format("2006-01-02")}); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE public.forex_instruments
+		SET segmento = $3, descripcion = $4, tipo_emision = $5, moneda = $6,
+		    last_seen = $7, active = true, updated_at = now()
+		WHERE ticker = $1 AND codigo_segmento = $2`,
+		o.Ticker, o.CodigoSegmento, o.Segmento, o.Descripcion, o.TipoEmision, o.Moneda, o.Date)
+	return err
+}
+
+func insertInstrumentVersion(ctx context.Context, tx pgx.Tx, o Observation) error {
+	_, err := tx.Exec(ctx, `
+		INSERT INTO public.forex_instruments_history (
+			ticker, codigo_segmento, segmento, descripcion, tipo_emision, moneda, valid_from
+		) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		o.Ticker, o.CodigoSegmento, o.Segmento, o.Descripcion, o.TipoEmision, o.Moneda, o.Date)
+	return err
+}
+
+// notifyInstrument logs the event and publishes it on instrumentsChannel.
+// Notifications are delivered when the transaction commits.
+func notifyInstrument(ctx context.Context, tx pgx.Tx, e instrumentEvent) error {
+	slog.Info("Instrument "+e.Event, "ticker", e.Ticker, "segmento", e.CodigoSegmento, "date", e.Date)
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, "SELECT pg_notify($1, $2)", instrumentsChannel, string(payload))
+	return err
+}
+
+func instrumentStaleDays() int {
+	if v := os.Getenv("MAE_INSTRUMENT_STALE_DAYS"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err == nil && days > 0 {
+			return days
+		}
+		slog.Warn("Invalid MAE_INSTRUMENT_STALE_DAYS, using the default", "value", v, "default", defaultInstrumentStaleDays)
+	}
+	return defaultInstrumentStaleDays
+}
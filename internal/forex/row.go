@@ -0,0 +1,230 @@
+// Package forex holds what maescraper and historicoforex share to load
+// public.forex: the row built from an API record, the currency mappings, the
+// schema drift checks and the instrument master.
+package forex
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Quote is an API record in the terms the forex and historicoforex
+// endpoints share. Each command maps its own records to quotes.
+type Quote struct {
+	Fecha            string // "2024-11-15T00:00:00"
+	Ticker           string // e.g. "USB$T"
+	Descripcion      string
+	TipoEmision      string
+	Segmento         string // Mayorista/Minorista
+	CodigoSegmento   string
+	Plazo            string // e.g. "000"
+	CodigoPlazo      string
+	Moneda           string // e.g. "T"
+	FechaLiquidacion string // "0001-01-01T00:00:00" when there is none
+
+	Monto                float64 // forex: volumenAcumulado, historicoforex: volumen
+	Cotizacion           float64 // precioCierre
+	MontoAcumulado       float64 // forex: montoAcumulado, historicoforex: monto
+	PrecioUltimo         float64
+	UltimaTasa           float64
+	PrecioCierreAnterior float64
+	PrecioMinimo         float64
+	PrecioMaximo         float64
+	OpenInterest         int
+	Variacion            float64
+
+	// Extra holds the fields of the record the command does not map
+	Extra map[string]json.RawMessage
+
+	// Missing lists the price fields of the record that are absent, null or
+	// not numbers (see MissingFields); BuildRow rejects such a quote
+	Missing []string
+}
+
+// Row is a row of public.forex as written by the scrapers.
+// JSON tags use the column names.
+type Row struct {
+	// Existing columns
+	Date        time.Time  `json:"date"`
+	Rueda       string     `json:"rueda"`        // CAM1/CAM2
+	Instrumento string     `json:"instrumento"`  // e.g. "USB / ART 000"
+	CurrencyOut string     `json:"currency_out"` // ticker without "$T"
+	CurrencyIn  string     `json:"currency_in"`  // from moneda
+	Settle      *int       `json:"settle"`       // plazo as int
+	SettleDate  *time.Time `json:"settle_date"`  // fecha_liquidacion
+	Monto       float64    `json:"monto"`
+	Cotizacion  float64    `json:"cotizacion"`
+	Hora        *string    `json:"hora"` // not available in the new APIs
+
+	// New columns
+	Descripcion          string  `json:"descripcion"`
+	TipoEmision          string  `json:"tipo_emision"`
+	CodigoSegmento       string  `json:"codigo_segmento"`
+	CodigoPlazo          string  `json:"codigo_plazo"`
+	Moneda               string  `json:"moneda"`
+	MontoAcumulado       float64 `json:"monto_acumulado"`
+	PrecioUltimo         float64 `json:"precio_ultimo"`
+	UltimaTasa           float64 `json:"ultima_tasa"`
+	PrecioCierreAnterior float64 `json:"precio_cierre_anterior"`
+	PrecioMinimo         float64 `json:"precio_minimo"`
+	PrecioMaximo         float64 `json:"precio_maximo"`
+	OpenInterest         int     `json:"open_interest"`
+	Variacion            float64 `json:"variacion"`
+
+	// ISO columns
+	ISOCurrencyOut *string `json:"iso_currency_out"` // e.g. "USD"
+	ISOCurrencyIn  *string `json:"iso_currency_in"`  // e.g. "ARS"
+	SettlementType *string `json:"settlement_type"`  // cable/MEP/billete/transferencia
+
+	// Unknown API fields
+	ExtraFields json.RawMessage `json:"extra_fields"`
+}
+
+// InsertQuery inserts one forex row, see Row.Values.
+// Existing columns: date, rueda, instrumento, currency_out, currency_in, settle, settle_date, monto, cotizacion, hora
+// New columns: descripcion, tipo_emision, codigo_segmento, codigo_plazo, moneda, monto_acumulado,
+//
+//	precio_ultimo, ultima_tasa, precio_cierre_anterior, precio_minimo, precio_maximo,
+//	open_interest, variacion
+//
+// ISO columns: iso_currency_out, iso_currency_in, settlement_type
+// Unknown API fields: extra_fields
+const InsertQuery = `
+		INSERT INTO public.forex (
+			date, rueda, instrumento, currency_out, currency_in, settle, settle_date, monto, cotizacion, hora,
+			descripcion, tipo_emision, codigo_segmento, codigo_plazo, moneda, monto_acumulado,
+			precio_ultimo, ultima_tasa, precio_cierre_anterior, precio_minimo, precio_maximo,
+			open_interest, variacion,
+			iso_currency_out, iso_currency_in, settlement_type,
+			extra_fields
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10,
+		          $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23,
+		          $24, $25, $26, $27)`
+
+// BuildRow maps a quote to a forex row.
+func BuildRow(q Quote) (Row, error) {
+	// A price that could not be read would be stored as 0
+	if len(q.Missing) > 0 {
+		return Row{}, fmt.Errorf("missing or invalid prices: %s", strings.Join(q.Missing, ", "))
+	}
+
+	// Parse fecha - format: "2024-11-15T00:00:00"
+	fecha, err := time.Parse("2006-01-02T15:04:05", q.Fecha)
+	if err != nil {
+		return Row{}, fmt.Errorf("invalid fecha '%s': %w", q.Fecha, err)
+	}
+
+	// Derive currency codes, rueda and instrumento
+	currencyOut := deriveCurrencyOut(q.Ticker)
+	currencyIn := deriveCurrencyIn(q.Moneda)
+	rueda := deriveRueda(q.Segmento)
+	instrumento := buildInstrumento(currencyOut, currencyIn, q.Plazo)
+
+	// Normalized ISO currencies and settlement type
+	isoCurrencyOut, settlementType := deriveISOCurrencyOut(currencyOut)
+	isoCurrencyIn := deriveISOCurrencyIn(q.Moneda)
+
+	// Parse settle (plazo) to integer
+	var settleVal *int
+	if q.Plazo != "" {
+		s, err := strconv.Atoi(q.Plazo)
+		if err == nil {
+			settleVal = &s
+		}
+	}
+
+	// Parse fecha_liquidacion (nullable - "0001-01-01T00:00:00" means no date)
+	var settleDateVal *time.Time
+	if q.FechaLiquidacion != "" && q.FechaLiquidacion != "0001-01-01T00:00:00" {
+		t, err := time.Parse("2006-01-02T15:04:05", q.FechaLiquidacion)
+		if err == nil {
+			settleDateVal = &t
+		}
+	}
+
+	return Row{
+		Date:        fecha,
+		Rueda:       rueda,
+		Instrumento: instrumento,
+		CurrencyOut: currencyOut,
+		CurrencyIn:  currencyIn,
+		Settle:      settleVal,
+		SettleDate:  settleDateVal,
+		Monto:       q.Monto,
+		Cotizacion:  q.Cotizacion,
+
+		Descripcion:          q.Descripcion,
+		TipoEmision:          q.TipoEmision,
+		CodigoSegmento:       q.CodigoSegmento,
+		CodigoPlazo:          q.CodigoPlazo,
+		Moneda:               q.Moneda,
+		MontoAcumulado:       q.MontoAcumulado,
+		PrecioUltimo:         q.PrecioUltimo,
+		UltimaTasa:           q.UltimaTasa,
+		PrecioCierreAnterior: q.PrecioCierreAnterior,
+		PrecioMinimo:         q.PrecioMinimo,
+		PrecioMaximo:         q.PrecioMaximo,
+		OpenInterest:         q.OpenInterest,
+		Variacion:            q.Variacion,
+
+		ISOCurrencyOut: isoCurrencyOut,
+		ISOCurrencyIn:  isoCurrencyIn,
+		SettlementType: settlementType,
+
+		ExtraFields: ExtraFieldsJSON(q.Extra),
+	}, nil
+}
+
+// Values returns the row in the column order of InsertQuery.
+func (r Row) Values() []any {
+	return []any{
+		r.Date, r.Rueda, r.Instrumento, r.CurrencyOut, r.CurrencyIn,
+		r.Settle, r.SettleDate, r.Monto, r.Cotizacion, r.Hora,
+		r.Descripcion, r.TipoEmision, r.CodigoSegmento, r.CodigoPlazo, r.Moneda,
+		r.MontoAcumulado, r.PrecioUltimo, r.UltimaTasa, r.PrecioCierreAnterior,
+		r.PrecioMinimo, r.PrecioMaximo, r.OpenInterest, r.Variacion,
+		r.ISOCurrencyOut, r.ISOCurrencyIn, r.SettlementType,
+		r.ExtraFields,
+	}
+}
+
+// deriveCurrencyOut extracts the short currency code from the ticker.
+// Tickers ending in "$T" get it stripped: "USB$T" -> "USB", "MB$T" -> "MB"
+// Other tickers are kept as-is: "USMEP" -> "USMEP", "UBMEP" -> "UBMEP"
+func deriveCurrencyOut(ticker string) string {
+	return strings.TrimSuffix(ticker, "$T")
+}
+
+// deriveCurrencyIn maps the moneda field to the old-style currency_in code.
+// "T" (pesos transferencia) -> "ART"
+// Other values are returned as-is as fallback.
+func deriveCurrencyIn(moneda string) string {
+	switch moneda {
+	case "T":
+		return "ART"
+	default:
+		return moneda
+	}
+}
+
+// deriveRueda maps the segmento field to the old-style rueda code.
+// "Minorista" -> "CAM2", "Mayorista" -> "CAM1"
+func deriveRueda(segmento string) string {
+	switch segmento {
+	case "Minorista":
+		return "CAM2"
+	case "Mayorista":
+		return "CAM1"
+	default:
+		return segmento
+	}
+}
+
+// buildInstrumento builds the instrumento string in the old format:
+// "CURRENCY_OUT / CURRENCY_IN PLAZO" e.g. "USB / ART 000"
+func buildInstrumento(currencyOut, currencyIn, plazo string) string {
+	return fmt.Sprintf("%s / %s %s", currencyOut, currencyIn, plazo)
+}
@@ -0,0 +1,27 @@
+package forex
+
+import "testing"
+
+func TestBuildRowBadDates(t *testing.T) {
+	if _, err := BuildRow(Quote{Fecha: "15/11/2024", Ticker: "USB$T"}); err == nil {
+		t.Error("expected error for invalid fecha")
+	}
+
+	// An invalid or empty fecha_liquidacion is stored as NULL
+	for _, liq := range []string{"", "0001-01-01T00:00:00", "not-a-date"} {
+		row, err := BuildRow(Quote{Fecha: "2024-11-15T00:00:00", Ticker: "USB$T", FechaLiquidacion: liq})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if row.SettleDate != nil {
+			t.Errorf("fechaLiquidacion %q: settle_date = %v, want NULL", liq, row.SettleDate)
+		}
+	}
+}
+
+func TestBuildRowMissingPrices(t *testing.T) {
+	_, err := BuildRow(Quote{Fecha: "2024-11-15T00:00:00", Ticker: "USB$T", Missing: []string{"precioCierre"}})
+	if err == nil {
+		t.Error("expected error for a quote missing its closing price")
+	}
+}
@@ -0,0 +1,199 @@
+package forex
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Drift describes how the API response differs from the fields the
+// scraper expects.
+type Drift struct {
+	Added       []string // fields in the response that are not expected
+	Removed     []string // expected fields missing from at least one record
+	TypeChanged []string // "field: expected X, got Y"
+}
+
+func (d Drift) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.TypeChanged) == 0
+}
+
+// Report logs the drift for the given endpoint.
+func (d Drift) Report(endpoint string) {
+	slog.Warn("API schema drift detected", "endpoint", endpoint,
+		"added", d.Added, "removed", d.Removed, "type_changed", d.TypeChanged)
+}
+
+// ExpectedSchema derives the expected JSON field kinds from the json tags of
+// a struct, so the schema always matches what the scraper decodes.
+func ExpectedSchema(v any) map[string]string {
+	t := reflect.TypeOf(v)
+	schema := make(map[string]string)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		schema[name] = kindOfType(f.Type)
+	}
+	return schema
+}
+
+func kindOfType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "bool"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// JSONKind returns the JSON kind of a raw value.
+func JSONKind(raw json.RawMessage) string {
+	s := strings.TrimSpace(string(raw))
+	if s == "" {
+		return "null"
+	}
+	switch s[0] {
+	case '"':
+		return "string"
+	case 't', 'f':
+		return "bool"
+	case 'n':
+		return "null"
+	case '[':
+		return "array"
+	case '{':
+		return "object"
+	default:
+		return "number"
+	}
+}
+
+// kindMatches reports whether a raw value has the expected kind. Null is
+// accepted for any field.
+func kindMatches(raw json.RawMessage, want string) bool {
+	got := JSONKind(raw)
+	return got == "null" || got == want
+}
+
+// DetectDrift compares every record against the expected schema.
+// Null values are accepted for any field.
+func DetectDrift(records []map[string]json.RawMessage, expected map[string]string) Drift {
+	added := map[string]bool{}
+	missing := map[string]int{}
+	changed := map[string]string{}
+
+	for _, rec := range records {
+		for name, raw := range rec {
+			want, ok := expected[name]
+			if !ok {
+				added[name] = true
+				continue
+			}
+			if !kindMatches(raw, want) {
+				changed[name] = fmt.Sprintf("%s: expected %s, got %s", name, want, JSONKind(raw))
+			}
+		}
+		for name := range expected {
+			if _, ok := rec[name]; !ok {
+				missing[name]++
+			}
+		}
+	}
+
+	var drift Drift
+	for name := range added {
+		drift.Added = append(drift.Added, name)
+	}
+	for name, n := range missing {
+		drift.Removed = append(drift.Removed, fmt.Sprintf("%s (missing in %d/%d records)", name, n, len(records)))
+	}
+	for _, desc := range changed {
+		drift.TypeChanged = append(drift.TypeChanged, desc)
+	}
+	sort.Strings(drift.Added)
+	sort.Strings(drift.Removed)
+	sort.Strings(drift.TypeChanged)
+	return drift
+}
+
+// DecodeRecord decodes a raw record into v, leaving out the fields whose type
+// doesn't match the expected schema so a type change is reported as drift
+// instead of failing the decode. Those fields are kept by UnknownFields.
+func DecodeRecord(rec map[string]json.RawMessage, expected map[string]string, v any) error {
+	known := make(map[string]json.RawMessage, len(rec))
+	for name, raw := range rec {
+		if want, ok := expected[name]; ok && kindMatches(raw, want) {
+			known[name] = raw
+		}
+	}
+	b, err := json.Marshal(known)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// UnknownFields returns the fields of a record that are not in the expected
+// schema or whose type changed, or nil when there are none.
+func UnknownFields(rec map[string]json.RawMessage, expected map[string]string) map[string]json.RawMessage {
+	var extra map[string]json.RawMessage
+	for name, raw := range rec {
+		if want, ok := expected[name]; ok && kindMatches(raw, want) {
+			continue
+		}
+		if extra == nil {
+			extra = make(map[string]json.RawMessage)
+		}
+		extra[name] = raw
+	}
+	return extra
+}
+
+// MissingFields returns those of fields that the record lacks, has as null
+// or has with another type than the expected one, in the given order. They
+// decode as their zero value.
+func MissingFields(rec map[string]json.RawMessage, expected map[string]string, fields ...string) []string {
+	var missing []string
+	for _, name := range fields {
+		raw, ok := rec[name]
+		if !ok || JSONKind(raw) != expected[name] {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// ExtraFieldsJSON encodes the unknown fields for the extra_fields JSONB column.
+// Returns nil (stored as NULL) when there are no unknown fields.
+func ExtraFieldsJSON(extra map[string]json.RawMessage) json.RawMessage {
+	if len(extra) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(extra)
+	if err != nil {
+		slog.Error("Failed to encode extra fields", "error", err)
+		return nil
+	}
+	return b
+}
+
+// SchemaStrict reports whether schema drift should fail the run (MAE_SCHEMA_STRICT=true).
+func SchemaStrict() bool {
+	v := strings.ToLower(os.Getenv("MAE_SCHEMA_STRICT"))
+	return v == "true" || v == "1" || v == "yes"
+}
@@ -0,0 +1,43 @@
+package forex
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestDetectSchemaDrift(t *testing.T) {
+	var records []map[string]json.RawMessage
+	err := json.Unmarshal([]byte(`[
+		{"fecha":"2024-11-15T00:00:00","ticker":"USB$T","precioCierre":"996.75","hora":"11:32"},
+		{"fecha":null,"ticker":"USB$T","precioCierre":996.75}
+	]`), &records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"fecha": "string", "ticker": "string", "precioCierre": "number", "plazo": "string"}
+
+	drift := DetectDrift(records, expected)
+	if want := []string{"hora"}; !slices.Equal(drift.Added, want) {
+		t.Errorf("Added = %v, want %v", drift.Added, want)
+	}
+	if want := []string{"plazo (missing in 2/2 records)"}; !slices.Equal(drift.Removed, want) {
+		t.Errorf("Removed = %v, want %v", drift.Removed, want)
+	}
+	if want := []string{"precioCierre: expected number, got string"}; !slices.Equal(drift.TypeChanged, want) {
+		t.Errorf("TypeChanged = %v, want %v", drift.TypeChanged, want)
+	}
+}
+
+func TestMissingFields(t *testing.T) {
+	var rec map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(`{"precioCierre":"996.75","precioUltimo":996.5,"precioMinimo":null}`), &rec); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"precioCierre": "number", "precioUltimo": "number", "precioMinimo": "number", "precioMaximo": "number"}
+
+	got := MissingFields(rec, expected, "precioCierre", "precioUltimo", "precioMinimo", "precioMaximo")
+	if want := []string{"precioCierre", "precioMinimo", "precioMaximo"}; !slices.Equal(got, want) {
+		t.Errorf("MissingFields() = %v, want %v", got, want)
+	}
+}
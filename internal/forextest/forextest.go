@@ -0,0 +1,121 @@
+// Package forextest holds the test helpers of the commands that load
+// public.forex: a fake MAE endpoint answering with recorded responses from
+// testdata, and the expected rows built from them.
+package forextest
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jmtruffa/maescraper/internal/forex"
+)
+
+var update = flag.Bool("update", false, "rewrite the expected rows in testdata")
+
+// Serve starts a fake MAE endpoint that answers every request with the given
+// status and body, and points the base URL variable env at it. check, when
+// not nil, is called with each request to assert what the command sent.
+func Serve(t *testing.T, env string, status int, body []byte, check func(*http.Request)) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if check != nil {
+			check(r)
+		}
+		w.WriteHeader(status)
+		w.Write(body)
+	}))
+	t.Cleanup(srv.Close)
+	t.Setenv(env, srv.URL)
+}
+
+// ReadFixture returns testdata/<name>.
+func ReadFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	body, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// CheckRows compares the rows built from testdata/<fixture> with
+// testdata/<fixture>.rows.json. Run the tests with -update to rewrite it.
+func CheckRows(t *testing.T, fixture string, rows []forex.Row) {
+	t.Helper()
+	got, err := json.MarshalIndent(rows, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+
+	golden := filepath.Join("testdata", strings.TrimSuffix(fixture, ".json")+".rows.json")
+	if *update {
+		if err := os.WriteFile(golden, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("rows differ from %s:\n%s", golden, got)
+	}
+}
+
+// Mapping is what a forex row maps from the API record and derives from it,
+// in comparable form: dates as 2006-01-02 and NULLs as "".
+type Mapping struct {
+	Date, Rueda, Instrumento, CurrencyOut, CurrencyIn string
+	Settle, SettleDate                                string
+
+	Monto, Cotizacion, MontoAcumulado                              float64
+	PrecioUltimo, PrecioCierreAnterior, PrecioMinimo, PrecioMaximo float64
+
+	ISOCurrencyOut, ISOCurrencyIn, SettlementType string
+}
+
+// MappingOf returns the mapping of a row.
+func MappingOf(r forex.Row) Mapping {
+	m := Mapping{
+		Date:        r.Date.Format("2006-01-02"),
+		Rueda:       r.Rueda,
+		Instrumento: r.Instrumento,
+		CurrencyOut: r.CurrencyOut,
+		CurrencyIn:  r.CurrencyIn,
+
+		Monto:                r.Monto,
+		Cotizacion:           r.Cotizacion,
+		MontoAcumulado:       r.MontoAcumulado,
+		PrecioUltimo:         r.PrecioUltimo,
+		PrecioCierreAnterior: r.PrecioCierreAnterior,
+		PrecioMinimo:         r.PrecioMinimo,
+		PrecioMaximo:         r.PrecioMaximo,
+
+		ISOCurrencyOut: deref(r.ISOCurrencyOut),
+		ISOCurrencyIn:  deref(r.ISOCurrencyIn),
+		SettlementType: deref(r.SettlementType),
+	}
+	if r.Settle != nil {
+		m.Settle = strconv.Itoa(*r.Settle)
+	}
+	if r.SettleDate != nil {
+		m.SettleDate = r.SettleDate.Format("2006-01-02")
+	}
+	return m
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
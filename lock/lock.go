@@ -0,0 +1,170 @@
+// Package lock keeps runs that would load the same data from overlapping,
+// e.g. when cron starts a backfill while the previous one is still running.
+// Each command takes a named PostgreSQL advisory lock on its target database
+// before reading its watermark, and holds it until it is done. The holder is
+// recorded in public.run_locks (see sql/009_run_locks.sql), so a run that
+// finds the lock taken can tell which run has it.
+//
+// MAE_LOCK_WAIT is how long to wait for a lock that is taken, e.g. 10m; by
+// default the run is skipped at once (see runlog.Run.Skip).
+package lock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jmtruffa/maescraper/runlog"
+)
+
+// Names of the locks. The loaders share one, since both write public.forex.
+const (
+	Forex     = "forex"
+	Sync      = "syncforex"
+	SyncPush  = "syncforex push"
+	Migration = "migrate"
+)
+
+// pollInterval is how often a taken lock is tried again while waiting.
+const pollInterval = 2 * time.Second
+
+// Lock is an advisory lock held on a connection.
+type Lock struct {
+	conn  *pgx.Conn
+	name  string
+	runID string
+}
+
+// HeldError is returned by Acquire when another session holds the lock.
+type HeldError struct {
+	Name    string
+	PID     int    // 0 when the holder could not be found
+	RunID   string // "" when the holder did not record itself
+	Command string
+	Since   time.Time
+}
+
+func (e *HeldError) Error() string {
+	switch {
+	case e.PID == 0:
+		return fmt.Sprintf("lock %s is held by another session", e.Name)
+	case e.RunID == "":
+		return fmt.Sprintf("lock %s is held by pid %d", e.Name, e.PID)
+	}
+	return fmt.Sprintf("lock %s is held by run %s (%s, pid %d) since %s",
+		e.Name, e.RunID, e.Command, e.PID, e.Since.Local().Format("2006-01-02 15:04:05"))
+}
+
+// Acquire takes the named lock on conn for the run, waiting up to
+// MAE_LOCK_WAIT for it. When it stays taken the error is a *HeldError.
+func Acquire(ctx context.Context, conn *pgx.Conn, name string, run *runlog.Run) (*Lock, error) {
+	var runID, command string
+	if run != nil {
+		runID, command = run.RunID, run.Command
+	}
+	deadline := time.Now().Add(waitTime())
+	for {
+		var ok bool
+		if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", key(name)).Scan(&ok); err != nil {
+			return nil, fmt.Errorf("lock %s: %w", name, err)
+		}
+		if ok {
+			break
+		}
+		if !time.Now().Before(deadline) {
+			return nil, holder(ctx, conn, name)
+		}
+		slog.Info("Waiting for lock", "lock", name)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+
+	_, err := conn.Exec(ctx, `
+		INSERT INTO public.run_locks (name, run_id, command, pid)
+		VALUES ($1, $2, $3, pg_backend_pid())
+		ON CONFLICT (name) DO UPDATE
+		SET run_id = EXCLUDED.run_id, command = EXCLUDED.command,
+		    pid = EXCLUDED.pid, acquired_at = now()`, name, runID, command)
+	if err != nil {
+		// The lock is held all the same; others only cannot tell by whom
+		slog.Warn("Unable to record lock holder", "lock", name, "error", err)
+	}
+	slog.Debug("Lock acquired", "lock", name)
+	return &Lock{conn: conn, name: name, runID: runID}, nil
+}
+
+// Release gives the lock up. Closing the connection does too, so a run that
+// dies never leaves it taken.
+func (l *Lock) Release(ctx context.Context) {
+	if l == nil || l.conn.IsClosed() {
+		return
+	}
+	// A row left behind is stale once the pid no longer holds the lock
+	l.conn.Exec(ctx, "DELETE FROM public.run_locks WHERE name = $1 AND run_id = $2", l.name, l.runID)
+	if _, err := l.conn.Exec(ctx, "SELECT pg_advisory_unlock($1)", key(l.name)); err != nil {
+		slog.Warn("Unable to release lock", "lock", l.name, "error", err)
+	}
+}
+
+// holder describes the session holding the lock.
+func holder(ctx context.Context, conn *pgx.Conn, name string) error {
+	k := key(name)
+	e := &HeldError{Name: name}
+	var runID, command *string
+	var since *time.Time
+	err := conn.QueryRow(ctx, `
+		SELECT l.pid, r.run_id, r.command, r.acquired_at
+		FROM pg_locks l
+		LEFT JOIN public.run_locks r ON r.name = $3 AND r.pid = l.pid
+		WHERE l.locktype = 'advisory' AND l.granted
+		  AND l.classid::bigint = $1 AND l.objid::bigint = $2 AND l.objsubid = 1
+		LIMIT 1`, int64(uint64(k)>>32), int64(uint32(k)), name).Scan(&e.PID, &runID, &command, &since)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		// Released in the meantime; the next run will get it
+		return e
+	case err != nil:
+		slog.Warn("Unable to find lock holder", "lock", name, "error", err)
+		return e
+	}
+	if runID != nil {
+		e.RunID, e.Command, e.Since = *runID, *command, *since
+	}
+	return e
+}
+
+// key is the advisory lock key of a name.
+func key(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("maescraper:" + name))
+	return int64(h.Sum64())
+}
+
+// waitTime is MAE_LOCK_WAIT, 0 by default.
+func waitTime() time.Duration {
+	v := os.Getenv("MAE_LOCK_WAIT")
+	if v == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		slog.Warn("Invalid MAE_LOCK_WAIT, not waiting", "value", v)
+		return 0
+	}
+	return d
+}
+
+// Held tells whether an error of Acquire means another session holds the
+// lock, so the run should be skipped rather than failed.
+func Held(err error) bool {
+	var held *HeldError
+	return errors.As(err, &held)
+}
@@ -0,0 +1,42 @@
+package lock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKey(t *testing.T) {
+	seen := map[int64]string{}
+	for _, name := range []string{Forex, Sync, SyncPush, Migration} {
+		k := key(name)
+		if other, ok := seen[k]; ok {
+			t.Errorf("%s and %s share key %d", name, other, k)
+		}
+		seen[k] = name
+		if key(name) != k {
+			t.Errorf("key(%s) is not stable", name)
+		}
+	}
+}
+
+func TestHeldError(t *testing.T) {
+	since := time.Date(2024, 11, 15, 18, 0, 0, 0, time.Local)
+	for e, want := range map[*HeldError]string{
+		{Name: Forex}:           "lock forex is held by another session",
+		{Name: Forex, PID: 412}: "lock forex is held by pid 412",
+		{Name: Forex, PID: 412, RunID: "20241115T210000-1a2b3c4d", Command: "historicoforex", Since: since}: "lock forex is held by run 20241115T210000-1a2b3c4d (historicoforex, pid 412) since 2024-11-15 18:00:00",
+	} {
+		if got := e.Error(); got != want {
+			t.Errorf("Error() = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestWaitTime(t *testing.T) {
+	for v, want := range map[string]time.Duration{"": 0, "90s": 90 * time.Second, "soon": 0, "-1m": 0} {
+		t.Setenv("MAE_LOCK_WAIT", v)
+		if got := waitTime(); got != want {
+			t.Errorf("MAE_LOCK_WAIT=%q: waitTime() = %s, want %s", v, got, want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// Package logging sets up log/slog for maescraper, historicoforex and
+// syncforex, so their output can be parsed by a log pipeline.
+package logging
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/jmtruffa/maescraper/secrets"
+)
+
+// Setup makes a logger writing to stderr the default for slog and for the
+// standard log package. MAE_LOG_FORMAT selects text (default) or json, and
+// MAE_LOG_LEVEL the lowest level logged: debug, info (default), warn or
+// error. Every record carries the command and run id. Secrets are redacted
+// from messages and values, see secrets.Redact.
+func Setup(command, runID string) *slog.Logger {
+	logger := New(os.Stderr, os.Getenv("MAE_LOG_FORMAT"), os.Getenv("MAE_LOG_LEVEL")).
+		With("command", command, "run_id", runID)
+	slog.SetDefault(logger)
+	return logger
+}
+
+// New returns a logger with the given format and level, falling back to text
+// and info (with a warning) for values it does not know.
+func New(w io.Writer, format, level string) *slog.Logger {
+	var lvl slog.Level
+	badLevel := level != "" && lvl.UnmarshalText([]byte(level)) != nil
+	if badLevel {
+		lvl = slog.LevelInfo
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl, ReplaceAttr: redact}
+	var logger *slog.Logger
+	switch strings.ToLower(format) {
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(w, opts))
+	case "", "text":
+		logger = slog.New(slog.NewTextHandler(w, opts))
+	default:
+		logger = slog.New(slog.NewTextHandler(w, opts))
+		logger.Warn("Unknown MAE_LOG_FORMAT, using text", "format", format)
+	}
+	if badLevel {
+		logger.Warn("Unknown MAE_LOG_LEVEL, using info", "level", level)
+	}
+	return logger
+}
+
+// redact hides secrets in string and error values, the message included.
+func redact(_ []string, a slog.Attr) slog.Attr {
+	switch v := a.Value; {
+	case v.Kind() == slog.KindString:
+		a.Value = slog.StringValue(secrets.Redact(v.String()))
+	case v.Kind() == slog.KindAny:
+		if err, ok := v.Any().(error); ok {
+			a.Value = slog.StringValue(secrets.Redact(err.Error()))
+		}
+	}
+	return a
+}
@@ -0,0 +1,67 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jmtruffa/maescraper/secrets"
+)
+
+func TestNewJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, "json", "warn").With("command", "maescraper", "run_id", "r1")
+	logger.Info("not logged")
+	logger.Warn("Skipping record", "ticker", "USB$T", "plazo", "000")
+
+	var rec map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("output is not one JSON record: %v\n%s", err, buf.String())
+	}
+	for k, want := range map[string]any{"level": "WARN", "msg": "Skipping record", "command": "maescraper",
+		"run_id": "r1", "ticker": "USB$T", "plazo": "000"} {
+		if rec[k] != want {
+			t.Errorf("%s = %v, want %v", k, rec[k], want)
+		}
+	}
+}
+
+func TestNewFallbacks(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, "xml", "loud")
+	logger.Debug("not logged")
+	logger.Info("logged")
+
+	out := buf.String()
+	for _, want := range []string{"Unknown MAE_LOG_FORMAT", "Unknown MAE_LOG_LEVEL", "msg=logged"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "not logged") {
+		t.Errorf("debug record logged at the default level:\n%s", out)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	t.Setenv("MAE_API_KEY", "k3y-abc123")
+	if _, err := secrets.Get("MAE_API_KEY"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	logger := New(&buf, "text", "")
+	logger.Error("Request with k3y-abc123 failed", "error", errors.New("dial postgres://sync:hunter22@db/forex"),
+		"key", "k3y-abc123")
+
+	out := buf.String()
+	for _, secret := range []string{"k3y-abc123", "hunter22"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("output contains %s:\n%s", secret, out)
+		}
+	}
+	if !strings.Contains(out, "postgres://sync:*****@db/forex") {
+		t.Errorf("output does not contain the redacted DSN:\n%s", out)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strconv"
@@ -13,12 +14,30 @@ import (
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jmtruffa/maescraper/dbconfig"
+	"github.com/jmtruffa/maescraper/internal/forex"
+	"github.com/jmtruffa/maescraper/lock"
+	"github.com/jmtruffa/maescraper/logging"
+	"github.com/jmtruffa/maescraper/metrics"
+	"github.com/jmtruffa/maescraper/runlog"
+	"github.com/jmtruffa/maescraper/secrets"
 )
 
 const (
-	apiURL = "https://api.mae.com.ar/MarketData/v1/mercado/cotizaciones/forex"
+	defaultAPIBaseURL = "https://api.mae.com.ar"
+	forexPath         = "/MarketData/v1/mercado/cotizaciones/forex"
 )
 
+// forexURL returns the forex endpoint URL. MAE_API_BASE_URL overrides the
+// host, e.g. to point the scraper at the local emulator.
+func forexURL() string {
+	baseURL := os.Getenv("MAE_API_BASE_URL")
+	if baseURL == "" {
+		baseURL = defaultAPIBaseURL
+	}
+	return strings.TrimSuffix(baseURL, "/") + forexPath
+}
+
 // ForexData represents the structure of the new API response
 type ForexData struct {
 	Fecha                string  `json:"fecha"`
@@ -41,233 +60,384 @@ type ForexData struct {
 	OpenInterest         int     `json:"openInterest"`
 	PrecioCierre         float64 `json:"precioCierre"`
 	Variacion            float64 `json:"variacion"`
-}
 
-// deriveCurrencyOut extracts the short currency code from the ticker.
-// Tickers ending in "$T" get it stripped: "USB$T" -> "USB", "MB$T" -> "MB"
-// Other tickers are kept as-is: "USMEP" -> "USMEP", "UBMEP" -> "UBMEP"
-func deriveCurrencyOut(ticker string) string {
-	return strings.TrimSuffix(ticker, "$T")
-}
+	// Extra holds fields returned by the API that are not mapped above
+	Extra map[string]json.RawMessage `json:"-"`
 
-// deriveCurrencyIn maps the moneda field to the old-style currency_in code.
-// "T" (pesos transferencia) -> "ART"
-// Other values are returned as-is as fallback.
-func deriveCurrencyIn(moneda string) string {
-	switch moneda {
-	case "T":
-		return "ART"
-	default:
-		return moneda
-	}
+	// Missing lists the prices the record lacks or has with another type
+	Missing []string `json:"-"`
 }
 
-// deriveRueda maps the segmento field to the old-style rueda code.
-// "Minorista" -> "CAM2", "Mayorista" -> "CAM1"
-func deriveRueda(segmento string) string {
-	switch segmento {
-	case "Minorista":
-		return "CAM2"
-	case "Mayorista":
-		return "CAM1"
-	default:
-		return segmento
-	}
-}
+var (
+	// forexSchema is the expected shape of each record of the forex endpoint.
+	forexSchema = forex.ExpectedSchema(ForexData{})
+
+	// forexPrices are the fields a record cannot be loaded without.
+	forexPrices = []string{"precioCierre", "precioUltimo", "precioCierreAnterior", "precioMinimo", "precioMaximo"}
+)
 
-// buildInstrumento builds the instrumento string in the old format:
-// "CURRENCY_OUT / CURRENCY_IN PLAZO" e.g. "USB / ART 000"
-func buildInstrumento(currencyOut, currencyIn, plazo string) string {
-	return fmt.Sprintf("%s / %s %s", currencyOut, currencyIn, plazo)
+// Quote maps the record to the terms shared with historicoforex.
+func (d ForexData) Quote() forex.Quote {
+	return forex.Quote{
+		Fecha:                d.Fecha,
+		Ticker:               d.Ticker,
+		Descripcion:          d.Descripcion,
+		TipoEmision:          d.TipoEmision,
+		Segmento:             d.Segmento,
+		CodigoSegmento:       d.CodigoSegmento,
+		Plazo:                d.Plazo,
+		CodigoPlazo:          d.CodigoPlazo,
+		Moneda:               d.Moneda,
+		FechaLiquidacion:     d.FechaLiquidacion,
+		Monto:                float64(d.VolumenAcumulado),
+		Cotizacion:           d.PrecioCierre,
+		MontoAcumulado:       d.MontoAcumulado,
+		PrecioUltimo:         d.PrecioUltimo,
+		UltimaTasa:           d.UltimaTasa,
+		PrecioCierreAnterior: d.PrecioCierreAnterior,
+		PrecioMinimo:         d.PrecioMinimo,
+		PrecioMaximo:         d.PrecioMaximo,
+		OpenInterest:         d.OpenInterest,
+		Variacion:            d.Variacion,
+		Extra:                d.Extra,
+		Missing:              d.Missing,
+	}
 }
 
-func main() {
-	fmt.Println("---------------------------------------------")
-	currentTime := time.Now().Format("2006-01-02 15:04:05")
-	fmt.Printf("Iniciando maeScraper a las: %s\n", currentTime)
+// fetch loads the current forex quotes; as "maescraper flush" it only
+// replays the spool.
+//
+// Every run first replays rows spooled while the database was unavailable
+// (see flushSpool), holding the forex lock. Every run is recorded in
+// public.ingest_runs; "runs" lists the most recent ones (see listRuns).
+//
+// Logs go to stderr through log/slog (see logging.Setup); a summary of the
+// run is printed to stdout at the end. The exit code tells the outcome, see
+// runlog.Status.ExitCode.
+func fetch(ctx context.Context, command string) {
+	run := runlog.Start(ctx, command)
+	logging.Setup(command, run.RunID)
+	slog.Info("Iniciando maeScraper", "version", run.Version)
 
-	forexData := fetchForexData()
-	if forexData != nil {
-		saveToDatabase(forexData)
-	} else {
-		fmt.Println("Data fetching failed.")
+	if flushPending(ctx, run) && command == "maescraper" && ctx.Err() == nil {
+		if forexData := fetchForexData(ctx, run); forexData != nil {
+			saveToDatabase(ctx, forexData, run)
+		}
 	}
-
-	currentTime = time.Now().Format("2006-01-02 15:04:05")
-	fmt.Printf("Proceso finalizado a las: %s\n", currentTime)
-	fmt.Println("---------------------------------------------")
+	run.Exit()
 }
 
-func fetchForexData() []ForexData {
-	apiKey := os.Getenv("MAE_API_KEY")
+// fetchForexData returns the current forex records, or nil when they cannot be
+// fetched. The response status, record count and any error go into run.
+func fetchForexData(ctx context.Context, run *runlog.Run) []ForexData {
+	apiKey, err := secrets.Get("MAE_API_KEY")
+	if err != nil {
+		run.Fatalf(runlog.StatusValidation, "%v", err)
+	}
 	if apiKey == "" {
-		log.Fatal("MAE_API_KEY environment variable not set")
+		run.Fatalf(runlog.StatusValidation, "MAE_API_KEY is not set (see package secrets)")
 	}
 
-	req, err := http.NewRequest("GET", apiURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", forexURL(), nil)
 	if err != nil {
-		log.Printf("Failed to create request: %v", err)
+		slog.Error("Failed to create request", "error", err)
+		run.Failf(runlog.StatusSource, "create request: %v", err)
 		return nil
 	}
 	req.Header.Set("x-api-key", apiKey)
 
 	client := &http.Client{Timeout: 30 * time.Second}
+	start := time.Now()
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("Failed to fetch data from API: %v", err)
+		metrics.ObserveAPI("maescraper", 0, time.Since(start))
+		slog.Error("Failed to fetch data from API", "error", err)
+		run.Failf(runlog.StatusSource, "fetch data from API: %v", err)
 		return nil
 	}
 	defer resp.Body.Close()
+	metrics.ObserveAPI("maescraper", resp.StatusCode, time.Since(start))
+	run.SetHTTPStatus(resp.StatusCode)
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		log.Printf("API returned status %d: %s", resp.StatusCode, string(body))
+		slog.Error("API returned an error", "status", resp.StatusCode, "body", string(body))
+		run.Failf(runlog.StatusSource, "API returned status %d", resp.StatusCode)
+		return nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		slog.Error("Failed to read response body", "error", err)
+		run.Failf(runlog.StatusSource, "read response body: %v", err)
 		return nil
 	}
 
 	// The new API returns a flat JSON array: [{ ... }, { ... }]
-	var data []ForexData
-	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-		log.Printf("Failed to decode JSON: %v", err)
+	// Decode it as raw records first to check the schema and keep unknown fields
+	var records []map[string]json.RawMessage
+	if err := json.Unmarshal(body, &records); err != nil {
+		slog.Error("Failed to decode JSON", "error", err)
+		run.Failf(runlog.StatusValidation, "decode JSON: %v", err)
 		return nil
 	}
+	if drift := forex.DetectDrift(records, forexSchema); !drift.Empty() {
+		drift.Report("forex")
+		if forex.SchemaStrict() {
+			slog.Error("Aborting: MAE_SCHEMA_STRICT is set and the API schema changed")
+			run.Failf(runlog.StatusValidation, "API schema changed")
+			return nil
+		}
+	}
+
+	data := make([]ForexData, len(records))
+	for i, rec := range records {
+		if err := forex.DecodeRecord(rec, forexSchema, &data[i]); err != nil {
+			slog.Error("Failed to decode JSON", "error", err)
+			run.Failf(runlog.StatusValidation, "decode JSON: %v", err)
+			return nil
+		}
+		data[i].Extra = forex.UnknownFields(rec, forexSchema)
+		data[i].Missing = forex.MissingFields(rec, forexSchema, forexPrices...)
+	}
 
 	if len(data) == 0 {
-		fmt.Println("No data received from API.")
+		slog.Warn("No data received from API")
+		run.NoData()
 		return nil
 	}
 
-	fmt.Printf("Received %d records from API.\n", len(data))
+	slog.Info("Received records from API", "records", len(data))
+	run.Add(len(data), 0, 0, 0)
 	return data
 }
 
-func saveToDatabase(data []ForexData) {
-	if len(data) == 0 {
-		fmt.Println("No data to save.")
-		return
+// spool keeps rows that could not be written for the next run to replay.
+func spool(rows []forex.Row, run *runlog.Run) {
+	if keep(rows, run) {
+		run.Failf(runlog.StatusDatabase, "database unavailable, %d rows spooled", len(rows))
+	}
+}
+
+// keep writes the rows to the spool and reports whether there were any to
+// write. Rows that cannot be written are lost and fail the run.
+func keep(rows []forex.Row, run *runlog.Run) bool {
+	if len(rows) == 0 {
+		return false
+	}
+	path, err := spoolRows(spoolDir(), rows)
+	if err != nil {
+		slog.Error("Failed to spool rows, they are lost", "rows", len(rows), "error", err)
+		run.Failf(runlog.StatusDatabase, "spool %d rows: %v", len(rows), err)
+		return false
+	}
+	slog.Warn("Spooled rows, they will be inserted on the next run", "rows", len(rows), "path", path)
+	return true
+}
+
+// flushPending replays the spool if there is anything in it, holding the
+// forex lock. It returns false when the lock is held by another run, which
+// skips this one.
+func flushPending(ctx context.Context, run *runlog.Run) bool {
+	dir := spoolDir()
+	files, err := spooledFiles(dir)
+	if err != nil || len(files) == 0 {
+		return true
+	}
+	slog.Info("Replaying spooled files", "files", len(files), "dir", dir)
+
+	conn, err := dbconfig.Connect(ctx, dbconfig.FromEnv("POSTGRES_"))
+	if err != nil {
+		slog.Error("Unable to connect to database, spool kept", "error", err)
+		run.Failf(runlog.StatusDatabase, "replay spool: %v", err)
+		return true
+	}
+	defer conn.Close(context.Background())
+
+	l := lockForex(ctx, conn, run)
+	if l == nil {
+		return false
+	}
+	defer l.Release(context.Background())
+
+	n, err := flushSpool(ctx, conn, dir, run)
+	if err != nil {
+		slog.Error("Failed to replay spool", "error", err)
+		run.Failf(runlog.StatusDatabase, "replay spool: %v", err)
+	}
+	slog.Info("Inserted spooled rows into forex table", "rows", n)
+	run.Add(0, n, 0, 0)
+	if n > 0 {
+		run.Completed("%d filas del spool insertadas en forex", n)
+	}
+	return true
+}
+
+// lockForex takes the forex lock, which keeps an overlapping fetch, replay or
+// backfill from loading the same dates. It returns nil, with the run skipped
+// or failed, when the lock cannot be taken.
+func lockForex(ctx context.Context, conn *pgx.Conn, run *runlog.Run) *lock.Lock {
+	l, err := lock.Acquire(ctx, conn, lock.Forex, run)
+	if lock.Held(err) {
+		slog.Warn("Skipping run", "error", err)
+		run.Skip(err)
+		return nil
+	}
+	if err != nil {
+		slog.Error("Unable to take lock", "error", err)
+		run.Failf(runlog.StatusDatabase, "%v", err)
+		return nil
 	}
+	return l
+}
 
-	// Load environment variables
-	dbUser := os.Getenv("POSTGRES_USER")
-	dbPassword := os.Getenv("POSTGRES_PASSWORD")
-	dbHost := os.Getenv("POSTGRES_HOST")
-	dbPort := os.Getenv("POSTGRES_PORT")
-	if dbPort == "" {
-		dbPort = "5432"
+// listRuns prints the most recent runs: runs [limit] [command prefix].
+func listRuns(ctx context.Context, args []string) {
+	limit, command := 20, ""
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid limit '%s'", args[0])
+		}
+		limit = n
+	}
+	if len(args) > 1 {
+		command = args[1]
 	}
-	dbName := os.Getenv("POSTGRES_DB")
 
-	// Connect to PostgreSQL
-	connStr := fmt.Sprintf("postgresql://%s:%s@%s:%s/%s", dbUser, dbPassword, dbHost, dbPort, dbName)
-	conn, err := pgx.Connect(context.Background(), connStr)
+	conn, err := dbconfig.Connect(ctx, dbconfig.FromEnv("POSTGRES_"))
 	if err != nil {
 		log.Fatalf("Unable to connect to database: %v\n", err)
 	}
 	defer conn.Close(context.Background())
 
+	runs, err := runlog.List(ctx, conn, command, limit)
+	if err != nil {
+		log.Fatalf("Failed to list runs: %v", err)
+	}
+	runlog.Print(os.Stdout, runs)
+}
+
+// buildRows maps the records to forex rows, rejecting those that fail
+// validation.
+func buildRows(data []ForexData, run *runlog.Run) []forex.Row {
+	var rows []forex.Row
+	for _, d := range data {
+		row, err := forex.BuildRow(d.Quote())
+		if err != nil {
+			slog.Warn("Skipping record", recordAttrs(d, err)...)
+			run.Reject(rejection(d, err))
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// recordAttrs are the log fields identifying an API record.
+func recordAttrs(d ForexData, err error) []any {
+	return []any{"date", d.Fecha, "ticker", d.Ticker, "plazo", d.Plazo, "segmento", d.Segmento, "error", err}
+}
+
+// rejection describes a record that failed validation, for alerts.
+func rejection(d ForexData, err error) string {
+	return fmt.Sprintf("%s %s %s: %v", d.Fecha, d.Ticker, d.Plazo, err)
+}
+
+func saveToDatabase(ctx context.Context, data []ForexData, run *runlog.Run) {
+	if len(data) == 0 {
+		slog.Info("No data to save")
+		return
+	}
+
+	// Connect to PostgreSQL (POSTGRES_* or DATABASE_URL, see dbconfig.FromEnv)
+	conn, err := dbconfig.Connect(ctx, dbconfig.FromEnv("POSTGRES_"))
+	if err != nil {
+		// The live snapshot cannot be fetched again later, keep it on disk
+		slog.Error("Unable to connect to database", "error", err)
+		spool(buildRows(data, run), run)
+		return
+	}
+	defer conn.Close(context.Background())
+
+	// Likewise while another run holds the lock; the run is skipped
+	l := lockForex(ctx, conn, run)
+	if l == nil {
+		if rows := buildRows(data, run); keep(rows, run) {
+			run.Skip(fmt.Errorf("%d rows spooled for the next run", len(rows)))
+		}
+		return
+	}
+	defer l.Release(context.Background())
+
 	// Check last inserted date
 	var lastDate time.Time
-	err = conn.QueryRow(context.Background(), "SELECT MAX(date) FROM public.forex").Scan(&lastDate)
+	err = conn.QueryRow(ctx, "SELECT MAX(date) FROM public.forex").Scan(&lastDate)
 	if err != nil && err != pgx.ErrNoRows {
-		log.Printf("Failed to query last date: %v\n", err)
+		slog.Error("Failed to query last date", "error", err)
 	}
 
 	// Prepare insert statement
-	// Existing columns: date, rueda, instrumento, currency_out, currency_in, settle, settle_date, monto, cotizacion, hora
-	// New columns: descripcion, tipo_emision, codigo_segmento, codigo_plazo, moneda, monto_acumulado,
-	//              precio_ultimo, ultima_tasa, precio_cierre_anterior, precio_minimo, precio_maximo,
-	//              open_interest, variacion
-	query := `
-		INSERT INTO public.forex (
-			date, rueda, instrumento, currency_out, currency_in, settle, settle_date, monto, cotizacion, hora,
-			descripcion, tipo_emision, codigo_segmento, codigo_plazo, moneda, monto_acumulado,
-			precio_ultimo, ultima_tasa, precio_cierre_anterior, precio_minimo, precio_maximo,
-			open_interest, variacion
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10,
-		          $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23)`
-
-	_, err = conn.Prepare(context.Background(), "insert_forex", query)
+	_, err = conn.Prepare(ctx, "insert_forex", forex.InsertQuery)
 	if err != nil {
-		log.Printf("Failed to prepare statement: %v\n", err)
+		slog.Error("Failed to prepare statement", "error", err)
+		run.Failf(runlog.StatusDatabase, "prepare statement: %v", err)
 		return
 	}
 
 	successfulInserts := 0
 	skipped := 0
+	failed := 0
+	var unsaved []forex.Row
 	for _, d := range data {
-		// Parse fecha - format: "2024-11-15T00:00:00"
-		fecha, err := time.Parse("2006-01-02T15:04:05", d.Fecha)
+		row, err := forex.BuildRow(d.Quote())
 		if err != nil {
-			log.Printf("Invalid fecha '%s': %v", d.Fecha, err)
+			slog.Warn("Skipping record", recordAttrs(d, err)...)
+			run.Reject(rejection(d, err))
 			continue
 		}
+		run.SetRange(row.Date, row.Date)
 
 		// Skip records already in the database
-		if !lastDate.IsZero() && fecha.Format("2006-01-02") <= lastDate.Format("2006-01-02") {
+		if !lastDate.IsZero() && row.Date.Format("2006-01-02") <= lastDate.Format("2006-01-02") {
 			skipped++
 			continue
 		}
 
-		// Derive currency codes, rueda and instrumento
-		currencyOut := deriveCurrencyOut(d.Ticker)
-		currencyIn := deriveCurrencyIn(d.Moneda)
-		rueda := deriveRueda(d.Segmento)
-		instrumento := buildInstrumento(currencyOut, currencyIn, d.Plazo)
-
-		// Parse settle (plazo) to integer
-		var settleVal *int
-		if d.Plazo != "" {
-			s, err := strconv.Atoi(d.Plazo)
-			if err == nil {
-				settleVal = &s
-			}
-		}
-
-		// Parse fecha_liquidacion (nullable - "0001-01-01T00:00:00" means no date)
-		var settleDateVal *time.Time
-		if d.FechaLiquidacion != "" && d.FechaLiquidacion != "0001-01-01T00:00:00" {
-			t, err := time.Parse("2006-01-02T15:04:05", d.FechaLiquidacion)
-			if err == nil {
-				settleDateVal = &t
+		start := time.Now()
+		_, err = conn.Exec(ctx, "insert_forex", row.Values()...)
+		metrics.ObserveDBWrite("maescraper", "insert", start)
+		switch {
+		case err != nil && ctx.Err() != nil:
+			// Interrupted; the snapshot cannot be fetched again, so it is spooled
+			unsaved = append(unsaved, row)
+		case err != nil:
+			slog.Error("Failed to insert row", recordAttrs(d, err)...)
+			failed++
+			if isConnectionError(err) {
+				unsaved = append(unsaved, row)
 			}
-		}
-
-		_, err = conn.Exec(context.Background(), "insert_forex",
-			// Existing columns
-			fecha,                // date
-			rueda,                // rueda (CAM1/CAM2)
-			instrumento,          // instrumento (e.g. "USB / ART 000")
-			currencyOut,          // currency_out (parsed from descripcion)
-			currencyIn,           // currency_in (parsed from descripcion)
-			settleVal,            // settle (plazo as int)
-			settleDateVal,        // settle_date (fecha_liquidacion)
-			d.VolumenAcumulado,   // monto (API: volumenAcumulado)
-			d.PrecioCierre,       // cotizacion
-			nil,                  // hora (not available in new API)
-			// New columns
-			d.Descripcion,          // descripcion
-			d.TipoEmision,          // tipo_emision
-			d.CodigoSegmento,       // codigo_segmento
-			d.CodigoPlazo,          // codigo_plazo
-			d.Moneda,               // moneda
-			d.MontoAcumulado,       // monto_acumulado
-			d.PrecioUltimo,         // precio_ultimo
-			d.UltimaTasa,           // ultima_tasa
-			d.PrecioCierreAnterior, // precio_cierre_anterior
-			d.PrecioMinimo,         // precio_minimo
-			d.PrecioMaximo,         // precio_maximo
-			d.OpenInterest,         // open_interest
-			d.Variacion,            // variacion
-		)
-		if err != nil {
-			log.Printf("Failed to insert row (ticker=%s, fecha=%s): %v\n", d.Ticker, d.Fecha, err)
-		} else {
+		default:
 			successfulInserts++
 		}
 	}
 
 	if skipped > 0 {
-		fmt.Printf("Skipped %d records already in database.\n", skipped)
+		slog.Info("Skipped records already in database", "rows", skipped)
+	}
+	slog.Info("Inserted rows into forex table", "rows", successfulInserts)
+	run.Add(0, successfulInserts, skipped, failed)
+	run.Completed("%d filas insertadas en forex", successfulInserts)
+	if len(unsaved) > 0 {
+		spool(unsaved, run)
+		return
+	}
+	// Failed rows are weighed against MAE_FAILURE_THRESHOLD when the run ends
+
+	// Keep the instrument master up to date
+	quotes := make([]forex.Quote, len(data))
+	for i, d := range data {
+		quotes[i] = d.Quote()
 	}
-	fmt.Printf("Inserted %d rows into forex table.\n", successfulInserts)
+	forex.UpdateInstruments(ctx, conn, forex.Observations(quotes))
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jmtruffa/maescraper/internal/forex"
+	"github.com/jmtruffa/maescraper/internal/forextest"
+	"github.com/jmtruffa/maescraper/runlog"
+)
+
+// serveFixture starts a fake forex endpoint that answers with the given status and body.
+func serveFixture(t *testing.T, status int, body []byte) {
+	t.Helper()
+	forextest.Serve(t, "MAE_API_BASE_URL", status, body, func(r *http.Request) {
+		if r.URL.Path != forexPath {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if got := r.Header.Get("x-api-key"); got != "test-key" {
+			t.Errorf("x-api-key = %q, want %q", got, "test-key")
+		}
+	})
+	t.Setenv("MAE_API_KEY", "test-key")
+}
+
+// fixtureRows fetches a recorded response and builds its rows.
+func fixtureRows(t *testing.T, fixture string) []forex.Row {
+	t.Helper()
+	serveFixture(t, http.StatusOK, forextest.ReadFixture(t, fixture))
+	data := fetchForexData(t.Context(), nil)
+	if data == nil {
+		t.Fatal("fetchForexData returned nil")
+	}
+	var rows []forex.Row
+	for _, d := range data {
+		row, err := forex.BuildRow(d.Quote())
+		if err != nil {
+			t.Fatalf("BuildRow(%s): %v", d.Ticker, err)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// TestFixtureRows fetches each recorded response and compares the rows it
+// produces with testdata/<fixture>.rows.json. Run with -update to regenerate.
+func TestFixtureRows(t *testing.T) {
+	for _, fixture := range []string{"forex_2024-11-15.json", "forex_drift.json"} {
+		t.Run(fixture, func(t *testing.T) {
+			forextest.CheckRows(t, fixture, fixtureRows(t, fixture))
+		})
+	}
+}
+
+// TestFixtureMapping pins down what each record of the recorded response
+// maps to: monto is volumenAcumulado and cotizacion precioCierre.
+func TestFixtureMapping(t *testing.T) {
+	want := []forextest.Mapping{
+		{Date: "2024-11-15", Rueda: "CAM1", Instrumento: "USB / ART 000", CurrencyOut: "USB", CurrencyIn: "ART",
+			Settle: "0", SettleDate: "2024-11-15",
+			Monto: 12500000, Cotizacion: 995.5, MontoAcumulado: 12443750000,
+			PrecioUltimo: 995.5, PrecioCierreAnterior: 994, PrecioMinimo: 993.75, PrecioMaximo: 996,
+			ISOCurrencyOut: "USD", ISOCurrencyIn: "ARS", SettlementType: "billete"},
+		{Date: "2024-11-15", Rueda: "CAM1", Instrumento: "USB / ART 001", CurrencyOut: "USB", CurrencyIn: "ART",
+			Settle: "1", SettleDate: "2024-11-18",
+			Monto: 48300000, Cotizacion: 996.75, MontoAcumulado: 48143525000,
+			PrecioUltimo: 996.75, PrecioCierreAnterior: 995.25, PrecioMinimo: 995, PrecioMaximo: 997.5,
+			ISOCurrencyOut: "USD", ISOCurrencyIn: "ARS", SettlementType: "billete"},
+		{Date: "2024-11-15", Rueda: "CAM2", Instrumento: "USB / ART 000", CurrencyOut: "USB", CurrencyIn: "ART",
+			Settle: "0", SettleDate: "2024-11-15",
+			Monto: 350000, Cotizacion: 996, MontoAcumulado: 348600000,
+			PrecioUltimo: 996, PrecioCierreAnterior: 994.5, PrecioMinimo: 995, PrecioMaximo: 997,
+			ISOCurrencyOut: "USD", ISOCurrencyIn: "ARS", SettlementType: "billete"},
+		// No fechaLiquidacion ("0001-01-01T00:00:00") is NULL
+		{Date: "2024-11-15", Rueda: "CAM2", Instrumento: "USMEP / ART 000", CurrencyOut: "USMEP", CurrencyIn: "ART",
+			Settle: "0",
+			Monto:  820000, Cotizacion: 1158, MontoAcumulado: 949560000,
+			PrecioUltimo: 1158, PrecioCierreAnterior: 1161.5, PrecioMinimo: 1155, PrecioMaximo: 1162,
+			ISOCurrencyOut: "USD", ISOCurrencyIn: "ARS", SettlementType: "MEP"},
+		{Date: "2024-11-15", Rueda: "CAM1", Instrumento: "MB / ART 000", CurrencyOut: "MB", CurrencyIn: "ART",
+			Settle: "0", SettleDate: "2024-11-15",
+			ISOCurrencyOut: "USD", ISOCurrencyIn: "ARS", SettlementType: "transferencia"},
+	}
+
+	rows := fixtureRows(t, "forex_2024-11-15.json")
+	if len(rows) != len(want) {
+		t.Fatalf("%d rows, want %d", len(rows), len(want))
+	}
+	for i, r := range rows {
+		if got := forextest.MappingOf(r); got != want[i] {
+			t.Errorf("row %d:\n got %+v\nwant %+v", i, got, want[i])
+		}
+	}
+}
+
+func TestFetchForexDataErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{"server error", http.StatusInternalServerError, `{"message":"Internal Server Error"}`},
+		{"unauthorized", http.StatusUnauthorized, `{"message":"Unauthorized"}`},
+		{"empty array", http.StatusOK, `[]`},
+		{"malformed json", http.StatusOK, `[{"fecha":"2024-11-15T00:00:00","ticker":`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serveFixture(t, tt.status, []byte(tt.body))
+			if data := fetchForexData(t.Context(), nil); data != nil {
+				t.Errorf("fetchForexData(nil) = %d records, want nil", len(data))
+			}
+		})
+	}
+}
+
+func TestFetchForexDataStrictSchema(t *testing.T) {
+	serveFixture(t, http.StatusOK, forextest.ReadFixture(t, "forex_drift.json"))
+	t.Setenv("MAE_SCHEMA_STRICT", "true")
+	if data := fetchForexData(t.Context(), nil); data != nil {
+		t.Errorf("fetchForexData(nil) = %d records, want nil with MAE_SCHEMA_STRICT", len(data))
+	}
+}
+
+// A field whose type changed is reported as drift and kept in extra_fields;
+// the rest of the record is still loaded unless MAE_SCHEMA_STRICT is set.
+func TestFetchForexDataTypeChanged(t *testing.T) {
+	body := []byte(`[{"fecha":"2024-11-15T00:00:00","ticker":"USB$T","precioCierre":"996.75","precioUltimo":996.5}]`)
+	serveFixture(t, http.StatusOK, body)
+	data := fetchForexData(t.Context(), nil)
+	if len(data) != 1 {
+		t.Fatalf("fetchForexData(nil) = %d records, want 1", len(data))
+	}
+	if data[0].PrecioCierre != 0 || data[0].PrecioUltimo != 996.5 {
+		t.Errorf("PrecioCierre, PrecioUltimo = %v, %v, want 0, 996.5", data[0].PrecioCierre, data[0].PrecioUltimo)
+	}
+	if got := string(data[0].Extra["precioCierre"]); got != `"996.75"` {
+		t.Errorf("Extra[precioCierre] = %s, want \"996.75\"", got)
+	}
+	// Loading it would store a closing price of 0
+	if want := []string{"precioCierre", "precioCierreAnterior", "precioMinimo", "precioMaximo"}; !slices.Equal(data[0].Missing, want) {
+		t.Errorf("Missing = %v, want %v", data[0].Missing, want)
+	}
+	if _, err := forex.BuildRow(data[0].Quote()); err == nil {
+		t.Error("BuildRow() accepted a record without a closing price")
+	}
+
+	t.Setenv("MAE_SCHEMA_STRICT", "true")
+	if data := fetchForexData(t.Context(), nil); data != nil {
+		t.Errorf("fetchForexData(nil) = %d records, want nil with MAE_SCHEMA_STRICT", len(data))
+	}
+}
+
+func TestFetchForexDataCancelled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	t.Cleanup(srv.Close)
+	t.Setenv("MAE_API_BASE_URL", srv.URL)
+	t.Setenv("MAE_API_KEY", "test-key")
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	run := runlog.Start(ctx, "maescraper")
+	start := time.Now()
+	if data := fetchForexData(ctx, run); data != nil {
+		t.Errorf("fetchForexData() = %d records, want nil", len(data))
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("fetchForexData() took %s after the context was cancelled", elapsed)
+	}
+	if run.Status != runlog.StatusSource {
+		t.Errorf("Status = %s, want source_error", run.Status)
+	}
+}
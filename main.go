@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/jmtruffa/maescraper/config"
+	"github.com/jmtruffa/maescraper/emulator"
+	"github.com/jmtruffa/maescraper/historicoforex"
+	"github.com/jmtruffa/maescraper/logging"
+	"github.com/jmtruffa/maescraper/runlog"
+	"github.com/jmtruffa/maescraper/syncforex"
+)
+
+const usage = `Usage: maescraper [flags] [command] [arguments]
+
+Commands:
+  fetch               load the current forex quotes (default)
+  backfill            load the dates missing since the newest in public.forex
+  sync [mode]         copy the tables to the destinations; mode is sync (default),
+                      verify, repair, cdc, push or serve
+  flush               replay the rows spooled while the database was unavailable
+  migrate             apply the SQL migrations not yet applied
+  schedule            run the jobs of the configuration file on their schedules,
+                      serving their state on MAE_SCHEDULER_ADDR (default :9110)
+  status              show the latest run of every command, the spool and migrations
+  emulator            serve the MAE API from the recorded responses in testdata,
+                      on EMULATOR_ADDR (default :8089)
+  runs [limit] [cmd]  list the most recent runs
+  version             print the version
+
+Flags, before or after the command:
+  -config FILE        configuration file (MAE_CONFIG; default ./maescraper.yaml,
+                      then maescraper/config.yaml under the user config directory)
+  -profile NAME       profile of the configuration file (MAE_PROFILE)
+  -log-format FORMAT  text or json (MAE_LOG_FORMAT)
+  -log-level LEVEL    debug, info, warn or error (MAE_LOG_LEVEL)
+  -set NAME=VALUE     set any setting, e.g. -set POSTGRES_DB=forex3; repeatable
+
+Flags override the environment, which overrides the configuration file.
+`
+
+// options are the flags shared by every command.
+type options struct {
+	config   string
+	profile  string
+	settings settings
+}
+
+// settings collects -set NAME=VALUE flags, and the flags that are shorthands
+// for a setting.
+type settings map[string]string
+
+func (s settings) String() string { return "" }
+
+func (s settings) Set(v string) error {
+	name, value, ok := strings.Cut(v, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("want NAME=VALUE, got %q", v)
+	}
+	s[name] = value
+	return nil
+}
+
+// setting is a flag setting one variable, e.g. -log-level for MAE_LOG_LEVEL.
+type setting struct {
+	s    settings
+	name string
+}
+
+func (f setting) String() string { return "" }
+
+func (f setting) Set(v string) error {
+	f.s[f.name] = v
+	return nil
+}
+
+// Usage: see usage. Every command is configured through environment
+// variables (see config for setting them from a file); its exit code tells
+// the outcome, see runlog.Status.ExitCode.
+//
+// SIGINT and SIGTERM cancel the context of the command, which stops at the
+// next safe point: requests and statements in flight are cancelled,
+// transactions rolled back, and the run recorded as interrupted with what it
+// completed. A second signal exits at once.
+func main() {
+	// Before configure, for the jobs of schedule
+	env := os.Environ()
+	opts, command, args, err := parseArgs(os.Args[1:], os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n\n%s", err, usage)
+		os.Exit(runlog.StatusValidation.ExitCode())
+	}
+	if err := configure(opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(runlog.StatusValidation.ExitCode())
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+		slog.Warn("Stopping, signal again to exit now", "cause", context.Cause(ctx))
+	}()
+
+	switch command {
+	case "fetch":
+		fetch(ctx, "maescraper")
+	case "flush":
+		fetch(ctx, "maescraper flush")
+	case "backfill":
+		historicoforex.Run(ctx)
+	case "sync":
+		syncforex.Run(ctx, args.mode)
+	case "migrate":
+		migrate(ctx)
+	case "schedule":
+		logging.Setup("maescraper schedule", "")
+		schedule(ctx, opts, env)
+	case "status":
+		logging.Setup("maescraper status", "")
+		status(ctx)
+	case "runs":
+		logging.Setup("maescraper runs", "")
+		listRuns(ctx, args.rest)
+	case "emulator":
+		logging.Setup("maescraper emulator", "")
+		emulator.Run(ctx)
+	case "version":
+		fmt.Println(runlog.BuildVersion())
+	}
+}
+
+// arguments are what follows the command.
+type arguments struct {
+	mode string   // of sync
+	rest []string // of runs
+}
+
+// parseArgs splits the command line into the shared flags, the command and
+// its arguments, checking the number of arguments of each command.
+func parseArgs(argv []string, stderr io.Writer) (options, string, arguments, error) {
+	opts := options{settings: settings{}}
+	fs := flag.NewFlagSet("maescraper", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.StringVar(&opts.config, "config", "", "")
+	fs.StringVar(&opts.profile, "profile", "", "")
+	fs.Var(setting{opts.settings, "MAE_LOG_FORMAT"}, "log-format", "")
+	fs.Var(setting{opts.settings, "MAE_LOG_LEVEL"}, "log-level", "")
+	fs.Var(opts.settings, "set", "")
+
+	var args arguments
+	parse := func(argv []string) ([]string, error) {
+		err := fs.Parse(argv)
+		if errors.Is(err, flag.ErrHelp) {
+			fmt.Fprint(stderr, usage)
+		}
+		return fs.Args(), err
+	}
+	rest, err := parse(argv)
+	if err != nil {
+		return opts, "", args, err
+	}
+	command := "fetch"
+	if len(rest) > 0 {
+		command = rest[0]
+		if rest, err = parse(rest[1:]); err != nil {
+			return opts, "", args, err
+		}
+	}
+
+	maxArgs := 0
+	switch command {
+	case "fetch", "flush", "backfill", "migrate", "schedule", "status", "emulator", "version":
+	case "sync":
+		maxArgs = 1
+		if len(rest) > 0 {
+			args.mode = rest[0]
+		}
+	case "runs":
+		maxArgs = 2
+		args.rest = rest
+	case "help":
+		fmt.Fprint(stderr, usage)
+		return opts, "", args, flag.ErrHelp
+	default:
+		return opts, "", args, fmt.Errorf("unknown command %q", command)
+	}
+	if len(rest) > maxArgs {
+		return opts, "", args, fmt.Errorf("too many arguments for %s: %s", command, strings.Join(rest, " "))
+	}
+	return opts, command, args, nil
+}
+
+// configure sets the environment from the configuration file, if there is
+// one, and then from the flags.
+func configure(opts options) error {
+	path := opts.config
+	if path == "" {
+		path = os.Getenv("MAE_CONFIG")
+	}
+	path = config.Find(path)
+	profile := opts.profile
+	if profile == "" {
+		profile = os.Getenv("MAE_PROFILE")
+	}
+
+	if path == "" {
+		if profile != "" {
+			return fmt.Errorf("profile %q selected but there is no configuration file", profile)
+		}
+	} else {
+		f, err := config.Load(path)
+		if err != nil {
+			return err
+		}
+		s, err := f.Settings(profile)
+		if err != nil {
+			return err
+		}
+		config.Apply(s)
+		if profile == "" {
+			profile = f.Profile
+		}
+	}
+	// Recorded for status
+	os.Setenv("MAE_CONFIG", path)
+	os.Setenv("MAE_PROFILE", profile)
+
+	for k, v := range opts.settings {
+		os.Setenv(k, v)
+	}
+	return nil
+}
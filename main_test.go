@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		argv    []string
+		command string
+		mode    string
+		runs    int
+		set     map[string]string
+		profile string
+	}{
+		{argv: nil, command: "fetch"},
+		{argv: []string{"-profile", "gcloud", "sync", "verify"}, command: "sync", mode: "verify", profile: "gcloud"},
+		{argv: []string{"sync", "-log-level", "debug", "cdc"}, command: "sync", mode: "cdc",
+			set: map[string]string{"MAE_LOG_LEVEL": "debug"}},
+		{argv: []string{"-set", "POSTGRES_DB=forex3", "runs", "10", "syncforex"}, command: "runs", runs: 2,
+			set: map[string]string{"POSTGRES_DB": "forex3"}},
+		{argv: []string{"backfill", "-set", "MAE_HISTORICO_BASE_URL=http://localhost:8080"}, command: "backfill",
+			set: map[string]string{"MAE_HISTORICO_BASE_URL": "http://localhost:8080"}},
+	}
+	for _, tt := range tests {
+		opts, command, args, err := parseArgs(tt.argv, io.Discard)
+		if err != nil {
+			t.Errorf("parseArgs(%q): %v", tt.argv, err)
+			continue
+		}
+		if command != tt.command || args.mode != tt.mode || len(args.rest) != tt.runs || opts.profile != tt.profile {
+			t.Errorf("parseArgs(%q) = %s %+v, profile %q", tt.argv, command, args, opts.profile)
+		}
+		for k, v := range tt.set {
+			if opts.settings[k] != v {
+				t.Errorf("parseArgs(%q): %s = %q, want %q", tt.argv, k, opts.settings[k], v)
+			}
+		}
+	}
+
+	for _, argv := range [][]string{{"scrape"}, {"fetch", "today"}, {"sync", "cdc", "now"}, {"-set", "POSTGRES_DB"}} {
+		if _, _, _, err := parseArgs(argv, io.Discard); err == nil {
+			t.Errorf("parseArgs(%q) succeeded", argv)
+		}
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "maescraper.yaml")
+	body := "profile: local\nprofiles:\n  local:\n    POSTGRES_DB: forex3\n    POSTGRES_HOST: localhost\n    MAE_LOG_LEVEL: warn\n  gcloud:\n    POSTGRES_DB: forex\n"
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"POSTGRES_DB", "POSTGRES_HOST", "MAE_LOG_LEVEL", "MAE_CONFIG", "MAE_PROFILE"} {
+		t.Setenv(k, "")
+		os.Unsetenv(k)
+	}
+	t.Setenv("POSTGRES_HOST", "db.internal")
+
+	opts := options{config: path, settings: settings{"MAE_LOG_LEVEL": "debug"}}
+	if err := configure(opts); err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]string{
+		"POSTGRES_DB":   "forex3",      // from the default profile
+		"POSTGRES_HOST": "db.internal", // the environment overrides the file
+		"MAE_LOG_LEVEL": "debug",       // flags override both
+		"MAE_PROFILE":   "local",
+	} {
+		if got := os.Getenv(k); got != want {
+			t.Errorf("%s = %q, want %q", k, got, want)
+		}
+	}
+
+	if err := configure(options{config: path, profile: "test"}); err == nil {
+		t.Error("unknown profile accepted")
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	ms, err := migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) == 0 || ms[0].Name != "001_forex_iso_currency.sql" {
+		t.Fatalf("migrations() = %d files, want sql/ starting with 001_forex_iso_currency.sql", len(ms))
+	}
+	for i, m := range ms {
+		if m.SQL == "" {
+			t.Errorf("%s is empty", m.Name)
+		}
+		if i > 0 && ms[i-1].Name >= m.Name {
+			t.Errorf("%s is out of order", m.Name)
+		}
+		// The cdc triggers are only for the local database
+		if want := m.Name == "011_forex_change_tracking_local.sql"; m.LocalOnly != want {
+			t.Errorf("%s: LocalOnly = %t, want %t", m.Name, m.LocalOnly, want)
+		}
+	}
+}
+func TestJobArgs(t *testing.T) {
+	for _, args := range [][]string{{"fetch"}, {"sync", "cdc"}, {"runs", "5"}} {
+		if err := checkJobArgs(args); err != nil {
+			t.Errorf("checkJobArgs(%q): %v", args, err)
+		}
+	}
+	for _, args := range [][]string{{"schedule"}, {"help"}, {"scrape"}, {"fetch", "today"}} {
+		if err := checkJobArgs(args); err == nil {
+			t.Errorf("checkJobArgs(%q) succeeded", args)
+		}
+	}
+
+	got := strings.Join(childFlags("/etc/maescraper.yaml", "gcloud", settings{"POSTGRES_DB": "forex3", "MAE_LOG_LEVEL": "debug"}), " ")
+	want := "-config /etc/maescraper.yaml -profile gcloud -set MAE_LOG_LEVEL=debug -set POSTGRES_DB=forex3"
+	if got != want {
+		t.Errorf("childFlags() = %s, want %s", got, want)
+	}
+}
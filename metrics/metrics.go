@@ -0,0 +1,144 @@
+// Package metrics holds the Prometheus metrics of maescraper, historicoforex
+// and syncforex. Long-running commands serve them on /metrics (see Handler);
+// cron-style runs write them to a node_exporter textfile when they finish
+// (see WriteTextfile).
+package metrics
+
+import (
+	"bufio"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Registry holds the application metrics only, so textfiles do not repeat
+// the Go runtime metrics node_exporter already exports about itself.
+var Registry = prometheus.NewRegistry()
+
+var (
+	apiDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "maescraper_api_request_duration_seconds",
+		Help:    "Duration of MAE API requests by response status (\"error\" when there was no response).",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"command", "status"})
+
+	rows = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "maescraper_rows_total",
+		Help: "Rows handled by outcome: fetched, inserted, skipped, failed or rejected.",
+	}, []string{"command", "outcome"})
+
+	dbWriteDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "maescraper_db_write_duration_seconds",
+		Help:    "Duration of database writes by operation.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"command", "operation"})
+
+	lastRun = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "maescraper_last_run_timestamp_seconds",
+		Help: "Unix time the last run of the command finished.",
+	}, []string{"command"})
+
+	lastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "maescraper_last_success_timestamp_seconds",
+		Help: "Unix time the last successful run of the command finished.",
+	}, []string{"command"})
+
+	runDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "maescraper_last_run_duration_seconds",
+		Help: "Duration of the last run of the command.",
+	}, []string{"command"})
+)
+
+func init() {
+	Registry.MustRegister(apiDuration, rows, dbWriteDuration, lastRun, lastSuccess, runDuration)
+}
+
+// ObserveAPI records a MAE API request; status is 0 when it got no response.
+func ObserveAPI(command string, status int, d time.Duration) {
+	label := "error"
+	if status != 0 {
+		label = strconv.Itoa(status)
+	}
+	apiDuration.WithLabelValues(command, label).Observe(d.Seconds())
+}
+
+// AddRows counts rows with the given outcome.
+func AddRows(command, outcome string, n int) {
+	if n > 0 {
+		rows.WithLabelValues(command, outcome).Add(float64(n))
+	}
+}
+
+// ObserveDBWrite records a database write that started at start.
+func ObserveDBWrite(command, operation string, start time.Time) {
+	dbWriteDuration.WithLabelValues(command, operation).Observe(time.Since(start).Seconds())
+}
+
+// RunFinished records the end of a run.
+func RunFinished(command string, started, finished time.Time, ok bool) {
+	lastRun.WithLabelValues(command).Set(float64(finished.Unix()))
+	runDuration.WithLabelValues(command).Set(finished.Sub(started).Seconds())
+	if ok {
+		lastSuccess.WithLabelValues(command).Set(float64(finished.Unix()))
+	}
+}
+
+// Succeeded marks a successful unit of work of a long-running command.
+func Succeeded(command string) {
+	lastSuccess.WithLabelValues(command).SetToCurrentTime()
+}
+
+// Handler serves the application metrics together with the Go runtime and
+// process metrics, for long-running commands.
+func Handler() http.Handler {
+	runtime := prometheus.NewRegistry()
+	runtime.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return promhttp.HandlerFor(prometheus.Gatherers{Registry, runtime}, promhttp.HandlerOpts{})
+}
+
+// WriteTextfile writes the metrics to <MAE_METRICS_TEXTFILE_DIR>/<command>.prom
+// for node_exporter's textfile collector, replacing the file atomically.
+// The last success is carried over from the file being replaced, so a failed
+// run does not drop it. It does nothing when MAE_METRICS_TEXTFILE_DIR is not set.
+func WriteTextfile(command string) error {
+	dir := os.Getenv("MAE_METRICS_TEXTFILE_DIR")
+	if dir == "" {
+		return nil
+	}
+	path := filepath.Join(dir, strings.ReplaceAll(command, " ", "_")+".prom")
+	if prev, ok := readLastSuccess(path, command); ok {
+		g := lastSuccess.WithLabelValues(command)
+		var m dto.Metric
+		if err := g.Write(&m); err == nil && m.GetGauge().GetValue() < prev {
+			g.Set(prev)
+		}
+	}
+	return prometheus.WriteToTextfile(path, Registry)
+}
+
+// readLastSuccess reads the command's last success from a textfile written
+// by WriteTextfile. It reports false when the file or the sample is missing.
+func readLastSuccess(path, command string) (float64, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	prefix := `maescraper_last_success_timestamp_seconds{command="` + command + `"} `
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(sc.Text(), prefix); ok {
+			ts, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			return ts, err == nil
+		}
+	}
+	return 0, false
+}
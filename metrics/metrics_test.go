@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteTextfile(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("MAE_METRICS_TEXTFILE_DIR", dir)
+
+	start := time.Now().Add(-2 * time.Second)
+	ObserveAPI("syncforex cdc", 200, 300*time.Millisecond)
+	ObserveAPI("syncforex cdc", 0, time.Second)
+	AddRows("syncforex cdc", "inserted", 42)
+	ObserveDBWrite("syncforex cdc", "insert", start)
+	RunFinished("syncforex cdc", start, time.Now(), true)
+	if err := WriteTextfile("syncforex cdc"); err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := os.ReadFile(filepath.Join(dir, "syncforex_cdc.prom"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`maescraper_api_request_duration_seconds_count{command="syncforex cdc",status="200"} 1`,
+		`maescraper_api_request_duration_seconds_count{command="syncforex cdc",status="error"} 1`,
+		`maescraper_rows_total{command="syncforex cdc",outcome="inserted"} 42`,
+		`maescraper_db_write_duration_seconds_count{command="syncforex cdc",operation="insert"} 1`,
+		`maescraper_last_success_timestamp_seconds{command="syncforex cdc"}`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("textfile does not contain %s:\n%s", want, body)
+		}
+	}
+}
+
+// A failed run keeps the last success written by an earlier run, even in a
+// new process that has not seen a success itself.
+func TestWriteTextfileKeepsLastSuccess(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("MAE_METRICS_TEXTFILE_DIR", dir)
+
+	success := time.Date(2024, 11, 15, 18, 0, 0, 0, time.UTC)
+	RunFinished("historicoforex", success.Add(-time.Minute), success, true)
+	if err := WriteTextfile("historicoforex"); err != nil {
+		t.Fatal(err)
+	}
+
+	// As a new process would start
+	lastSuccess.DeleteLabelValues("historicoforex")
+	failure := success.AddDate(0, 0, 1)
+	RunFinished("historicoforex", failure.Add(-time.Minute), failure, false)
+	if err := WriteTextfile("historicoforex"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok := readLastSuccess(filepath.Join(dir, "historicoforex.prom"), "historicoforex")
+	if !ok || got != float64(success.Unix()) {
+		t.Errorf("last success = %v (found %t), want %d", got, ok, success.Unix())
+	}
+}
+
+func TestWriteTextfileDisabled(t *testing.T) {
+	t.Setenv("MAE_METRICS_TEXTFILE_DIR", "")
+	if err := WriteTextfile("maescraper"); err != nil {
+		t.Errorf("WriteTextfile() = %v, want nil when disabled", err)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jmtruffa/maescraper/dbconfig"
+	"github.com/jmtruffa/maescraper/lock"
+	"github.com/jmtruffa/maescraper/logging"
+	"github.com/jmtruffa/maescraper/runlog"
+)
+
+//go:embed sql/*.sql
+var migrationFiles embed.FS
+
+// migration is one file of sql/, applied in the order of its name. A file
+// with a "-- target: local" line is only for the local database.
+type migration struct {
+	Name      string // e.g. 006_ingest_runs.sql
+	SQL       string
+	LocalOnly bool
+}
+
+// localTarget reports whether the POSTGRES_* database is the local one the
+// scrapers load (MAE_DB_ROLE=local, the default) rather than the cloud copy
+// (MAE_DB_ROLE=cloud).
+func localTarget() (bool, error) {
+	switch role := os.Getenv("MAE_DB_ROLE"); role {
+	case "", "local":
+		return true, nil
+	case "cloud":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid MAE_DB_ROLE '%s': must be local or cloud", role)
+	}
+}
+
+// migrations are the embedded SQL files, in order.
+func migrations() ([]migration, error) {
+	names, err := fs.Glob(migrationFiles, "sql/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	var ms []migration
+	for _, name := range names {
+		body, err := migrationFiles.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		localOnly := slices.Contains(strings.Split(string(body), "\n"), "-- target: local")
+		ms = append(ms, migration{Name: path.Base(name), SQL: string(body), LocalOnly: localOnly})
+	}
+	return ms, nil
+}
+
+// createMigrationsTable creates public.schema_migrations if needed.
+func createMigrationsTable(ctx context.Context, conn *pgx.Conn) error {
+	_, err := conn.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS public.schema_migrations (
+			name       text        PRIMARY KEY,
+			applied_at timestamptz NOT NULL DEFAULT now()
+		)`)
+	return err
+}
+
+// appliedMigrations are the names recorded in public.schema_migrations, none
+// when the table does not exist yet.
+func appliedMigrations(ctx context.Context, conn *pgx.Conn) (map[string]bool, error) {
+	var exists bool
+	err := conn.QueryRow(ctx, "SELECT to_regclass('public.schema_migrations') IS NOT NULL").Scan(&exists)
+	if err != nil || !exists {
+		return map[string]bool{}, err
+	}
+	rows, err := conn.Query(ctx, "SELECT name FROM public.schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	applied := make(map[string]bool, len(names))
+	for _, n := range names {
+		applied[n] = true
+	}
+	return applied, err
+}
+
+// pendingMigrations are the migrations for the database not yet applied, in
+// order. Local-only migrations are left out unless it is the local database.
+func pendingMigrations(ctx context.Context, conn *pgx.Conn) ([]migration, error) {
+	local, err := localTarget()
+	if err != nil {
+		return nil, err
+	}
+	all, err := migrations()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	var pending []migration
+	for _, m := range all {
+		if !applied[m.Name] && (local || !m.LocalOnly) {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// applyMigration runs the migration and records it, in one transaction.
+func applyMigration(ctx context.Context, conn *pgx.Conn, m migration) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer dbconfig.Rollback(ctx, tx)
+	if _, err := tx.Exec(ctx, m.SQL); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, "INSERT INTO public.schema_migrations (name) VALUES ($1)", m.Name); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// migrate applies the migrations of sql/ not yet recorded in
+// public.schema_migrations of the POSTGRES_* database, each in a transaction
+// of its own. The migrations are idempotent, so databases that were migrated
+// by hand before the table existed are only recorded. Select the database
+// with a profile, e.g. maescraper -profile gcloud migrate; migrations marked
+// local-only are skipped unless MAE_DB_ROLE is local. When interrupted
+// it stops after the migration being applied is rolled back.
+func migrate(ctx context.Context) {
+	run := runlog.Start(ctx, "maescraper migrate")
+	logging.Setup(run.Command, run.RunID)
+
+	conn, err := dbconfig.Connect(ctx, dbconfig.FromEnv("POSTGRES_"))
+	if err != nil {
+		run.Fatalf(runlog.StatusDatabase, "Unable to connect to database: %v", err)
+	}
+	defer conn.Close(context.Background())
+
+	l, err := lock.Acquire(ctx, conn, lock.Migration, run)
+	if lock.Held(err) {
+		slog.Warn("Skipping run", "error", err)
+		run.Skip(err)
+		run.Exit()
+	}
+	if err != nil {
+		run.Fatalf(runlog.StatusDatabase, "Unable to take lock: %v", err)
+	}
+
+	if _, err := localTarget(); err != nil {
+		run.Fatalf(runlog.StatusValidation, "%v", err)
+	}
+	if err := createMigrationsTable(ctx, conn); err != nil {
+		run.Fatalf(runlog.StatusDatabase, "Unable to create schema_migrations: %v", err)
+	}
+	pending, err := pendingMigrations(ctx, conn)
+	if err != nil {
+		run.Fatalf(runlog.StatusDatabase, "Unable to read applied migrations: %v", err)
+	}
+	if len(pending) == 0 {
+		slog.Info("Database is up to date. Nothing to do.")
+	}
+	for _, m := range pending {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := applyMigration(ctx, conn, m); err != nil {
+			run.Fatalf(runlog.StatusDatabase, "Migration %s failed: %v", m.Name, err)
+		}
+		slog.Info("Applied migration", "name", m.Name)
+		fmt.Println("Applied", strings.TrimSuffix(m.Name, ".sql"))
+		run.Completed("migración %s aplicada", m.Name)
+	}
+	l.Release(context.Background())
+	run.Exit()
+}
@@ -0,0 +1,502 @@
+// Package runlog records every run of maescraper, historicoforex and
+// syncforex in public.ingest_runs (see sql/006_ingest_runs.sql), so there is
+// a history of what each run fetched and wrote beyond the cron output.
+package runlog
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jmtruffa/maescraper/alert"
+	"github.com/jmtruffa/maescraper/calendar"
+	"github.com/jmtruffa/maescraper/dbconfig"
+	"github.com/jmtruffa/maescraper/metrics"
+	"github.com/jmtruffa/maescraper/secrets"
+)
+
+// Version is the build version stored with each run. Set it with
+// -ldflags "-X github.com/jmtruffa/maescraper/runlog.Version=v1.2.3";
+// otherwise the module version or VCS revision of the build is used.
+var Version string
+
+// Run is one run of a command and its statistics. The methods may be called
+// from several goroutines, and on a nil Run, where they do nothing.
+type Run struct {
+	ID         int64
+	RunID      string // logged with every record of the run, see logging.Setup
+	Command    string
+	StartedAt  time.Time
+	FinishedAt time.Time
+	From, To   time.Time // requested date range, zero when not applicable
+	Fetched    int
+	Inserted   int
+	Skipped    int
+	Failed     int
+	Rejected   int
+	HTTPStatus int // of the API call, 0 when there was none
+	Error      string
+	Status     Status // first failure recorded; the final outcome once finished
+	Version    string
+
+	rejected  []string      // reasons of the validation rejections
+	alerts    []alert.Alert // raised by the command, see Alert
+	completed []string      // units of work done, see Completed
+	ctx       context.Context
+
+	mu sync.Mutex
+}
+
+// Start begins recording a run of the command, e.g. "syncforex cdc". When
+// ctx is cancelled before the run finishes, e.g. by SIGTERM, the run ends as
+// StatusInterrupted.
+func Start(ctx context.Context, command string) *Run {
+	now := time.Now()
+	return &Run{RunID: newRunID(now), Command: command, StartedAt: now, Version: BuildVersion(), ctx: ctx}
+}
+
+// newRunID is the start time and a random suffix, e.g. 20241115T180000-1a2b3c4d.
+func newRunID(t time.Time) string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return t.UTC().Format("20060102T150405") + "-" + hex.EncodeToString(b)
+}
+
+// SetRange widens the requested date range to include from..to.
+func (r *Run) SetRange(from, to time.Time) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.From.IsZero() || from.Before(r.From) {
+		r.From = from
+	}
+	if to.After(r.To) {
+		r.To = to
+	}
+}
+
+// SetHTTPStatus records the status of the API response.
+func (r *Run) SetHTTPStatus(status int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.HTTPStatus = status
+}
+
+// Add adds to the row counts, and to the rows metric.
+func (r *Run) Add(fetched, inserted, skipped, failed int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Fetched += fetched
+	r.Inserted += inserted
+	r.Skipped += skipped
+	r.Failed += failed
+	metrics.AddRows(r.Command, "fetched", fetched)
+	metrics.AddRows(r.Command, "inserted", inserted)
+	metrics.AddRows(r.Command, "skipped", skipped)
+	metrics.AddRows(r.Command, "failed", failed)
+}
+
+// Reject records a row that failed validation and was not written.
+func (r *Run) Reject(reason string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Rejected++
+	r.rejected = append(r.rejected, reason)
+	metrics.AddRows(r.Command, "rejected", 1)
+}
+
+// Alert raises a warning to be sent when the run finishes, see alert.Notify.
+// The key identifies the condition, so it is sent once while it persists.
+func (r *Run) Alert(key, title, text string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.alerts = append(r.alerts, alert.Alert{Key: key, Severity: alert.Warning, Title: title, Text: text})
+}
+
+// Completed records a unit of work that is done for good, e.g. a date loaded
+// or a migration applied, for the summary of an interrupted run.
+func (r *Run) Completed(format string, args ...any) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.completed = append(r.completed, fmt.Sprintf(format, args...))
+}
+
+// Fail marks the run as failed with the given status. The first failure
+// sets the status; all are kept in Error, separated by "; ", with secrets
+// redacted (see secrets.Redact).
+func (r *Run) Fail(s Status, err error) {
+	if r == nil || err == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Status.Succeeded() {
+		r.Status = s
+	}
+	if r.Error != "" {
+		r.Error += "; "
+	}
+	r.Error += secrets.Redact(err.Error())
+}
+
+// Failf is Fail with a formatted message.
+func (r *Run) Failf(s Status, format string, args ...any) {
+	r.Fail(s, fmt.Errorf(format, args...))
+}
+
+// NoData records that the source had nothing to load.
+func (r *Run) NoData() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Status == StatusOK {
+		r.Status = StatusNoData
+	}
+}
+
+// Skip records that the run did nothing because another one held its lock;
+// err says which.
+func (r *Run) Skip(err error) {
+	if r == nil || err == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Status.Succeeded() {
+		r.Status = StatusSkipped
+	}
+	if r.Error != "" {
+		r.Error += "; "
+	}
+	r.Error += err.Error()
+}
+
+// Fatalf logs the message, records the run as failed with the given status
+// and exits, like log.Fatalf but with the status's exit code.
+func (r *Run) Fatalf(s Status, format string, args ...any) {
+	err := fmt.Errorf(format, args...)
+	slog.Error("Aborting run", "error", err)
+	if r == nil {
+		os.Exit(s.ExitCode())
+	}
+	r.Fail(s, err)
+	r.Exit()
+}
+
+// Exit finishes the run, prints its summary and exits with the exit code of
+// its outcome (see Status.ExitCode).
+func (r *Run) Exit() {
+	r.Finish()
+	r.PrintSummary(os.Stdout)
+	os.Exit(r.Status.ExitCode())
+}
+
+// Finish stores the run in the POSTGRES_* database over a connection of its
+// own, so it is recorded whatever state the command's connections are in,
+// writes the metrics textfile (see metrics.WriteTextfile) and sends its
+// alerts (see alert.Notify). Failures to do any of these are only logged.
+func (r *Run) Finish() {
+	if r == nil {
+		return
+	}
+	// Not the run's context, which may be cancelled already
+	ctx := context.Background()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.FinishedAt = time.Now()
+	r.Status = r.result()
+	if r.ctx != nil && r.ctx.Err() != nil {
+		// Whatever failed after the signal failed because of it
+		r.Status = StatusInterrupted
+		msg := context.Cause(r.ctx).Error()
+		if r.Error != "" {
+			msg += "; " + r.Error
+		}
+		r.Error = msg
+	}
+	if r.Status == StatusDatabase && r.Error == "" {
+		r.Error = fmt.Sprintf("%d of %d rows failed", r.Failed, r.attempted())
+	}
+	if r.Status == StatusValidation && r.Error == "" {
+		r.Error = fmt.Sprintf("%d of %d rows rejected in validation", r.Rejected, r.attempted())
+	}
+
+	// A skipped run loaded nothing, so it does not count as a success
+	metrics.RunFinished(r.Command, r.StartedAt, r.FinishedAt, r.Status.Succeeded() && r.Status != StatusSkipped)
+	if err := metrics.WriteTextfile(r.Command); err != nil {
+		slog.Warn("Unable to write metrics", "error", err)
+	}
+	alert.Notify(r.Command, r.RunID, r.findAlerts())
+
+	conn, err := dbconfig.Connect(ctx, dbconfig.FromEnv("POSTGRES_"))
+	if err != nil {
+		slog.Warn("Unable to record run", "error", err)
+		return
+	}
+	defer conn.Close(ctx)
+
+	err = conn.QueryRow(ctx, `
+		INSERT INTO public.ingest_runs (
+			command, started_at, finished_at, date_from, date_to,
+			rows_fetched, rows_inserted, rows_skipped, rows_failed, rows_rejected,
+			http_status, error, version, run_id, status, exit_code
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+		RETURNING id`,
+		r.Command, r.StartedAt, r.FinishedAt, nullDate(r.From), nullDate(r.To),
+		r.Fetched, r.Inserted, r.Skipped, r.Failed, r.Rejected,
+		nullInt(r.HTTPStatus), nullString(r.Error), r.Version, r.RunID,
+		r.Status.String(), r.Status.ExitCode()).Scan(&r.ID)
+	if err != nil {
+		slog.Warn("Unable to record run", "error", err)
+	}
+}
+
+// findAlerts are the alerts of the finished run: a failure, no data on a
+// business day, rows rejected by validation, and those raised by the command.
+// Callers hold r.mu.
+func (r *Run) findAlerts() []alert.Alert {
+	var alerts []alert.Alert
+	switch {
+	case r.Status == StatusInterrupted:
+		alerts = append(alerts, alert.Alert{Key: "interrupted", Severity: alert.Warning,
+			Title: fmt.Sprintf("%s was interrupted", r.Command), Text: r.Error})
+	case !r.Status.Succeeded():
+		alerts = append(alerts, alert.Alert{Key: "failed", Severity: alert.Critical,
+			Title: fmt.Sprintf("%s failed: %s", r.Command, r.Status), Text: r.Error})
+	}
+	if r.Status == StatusNoData && calendar.BusinessDay(r.StartedAt) {
+		alerts = append(alerts, alert.Alert{Key: "no_data", Severity: alert.Warning,
+			Title: fmt.Sprintf("%s loaded no rows on a business day", r.Command)})
+	}
+	if len(r.rejected) > 0 {
+		sample := r.rejected
+		if len(sample) > 5 {
+			sample = sample[:5]
+		}
+		text := strings.Join(sample, "\n")
+		if more := len(r.rejected) - len(sample); more > 0 {
+			text += fmt.Sprintf("\n... and %d more", more)
+		}
+		alerts = append(alerts, alert.Alert{Key: "rejected", Severity: alert.Warning,
+			Title: fmt.Sprintf("%s rejected %d rows in validation", r.Command, len(r.rejected)), Text: text})
+	}
+	return append(alerts, r.alerts...)
+}
+
+// PrintSummary writes a human-readable summary of the finished run, the
+// closing banner of every command.
+func (r *Run) PrintSummary(w io.Writer) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fmt.Fprintln(w, "---------------------------------------------")
+	fmt.Fprintf(w, "%s (%s)\n", r.Command, r.RunID)
+	if !r.From.IsZero() {
+		fmt.Fprintf(w, "Fechas: %s a %s\n", r.From.Format("2006-01-02"), r.To.Format("2006-01-02"))
+	}
+	fmt.Fprintf(w, "Filas: %d recibidas, %d insertadas, %d omitidas, %d fallidas, %d rechazadas\n",
+		r.Fetched, r.Inserted, r.Skipped, r.Failed, r.Rejected)
+	fmt.Fprintf(w, "Resultado: %s (exit %d)\n", r.outcome(), r.Status.ExitCode())
+	if r.Status == StatusInterrupted {
+		printCompleted(w, r.completed)
+	}
+	fmt.Fprintf(w, "Proceso finalizado a las: %s (%s)\n", r.FinishedAt.Format("2006-01-02 15:04:05"),
+		r.FinishedAt.Sub(r.StartedAt).Round(time.Millisecond))
+	fmt.Fprintln(w, "---------------------------------------------")
+}
+
+// printCompleted lists the work an interrupted run got done, the most recent
+// last.
+func printCompleted(w io.Writer, completed []string) {
+	if len(completed) == 0 {
+		fmt.Fprintln(w, "Completado antes de la interrupción: nada")
+		return
+	}
+	fmt.Fprintln(w, "Completado antes de la interrupción:")
+	if n := len(completed) - maxCompleted; n > 0 {
+		fmt.Fprintf(w, "  ... y %d más\n", n)
+		completed = completed[n:]
+	}
+	for _, c := range completed {
+		fmt.Fprintf(w, "  %s\n", c)
+	}
+}
+
+// maxCompleted is how many units of work the summary lists.
+const maxCompleted = 10
+
+// runColumns are the columns of ingest_runs read into a Run, see scanRuns.
+const runColumns = `
+		id, COALESCE(run_id, ''), command, started_at, finished_at,
+		COALESCE(date_from, '0001-01-01'), COALESCE(date_to, '0001-01-01'),
+		rows_fetched, rows_inserted, rows_skipped, rows_failed, rows_rejected,
+		COALESCE(http_status, 0), COALESCE(error, ''), version,
+		COALESCE(status, CASE WHEN error IS NULL THEN 'ok' ELSE 'failed' END)`
+
+// List returns the most recent runs, newest first, optionally only those of
+// commands starting with the given prefix.
+func List(ctx context.Context, conn *pgx.Conn, command string, limit int) ([]*Run, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT `+runColumns+`
+		FROM public.ingest_runs
+		WHERE starts_with(command, $1)
+		ORDER BY started_at DESC, id DESC
+		LIMIT $2`, command, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanRuns(rows)
+}
+
+// Latest returns the most recent run of every command, by command.
+func Latest(ctx context.Context, conn *pgx.Conn) ([]*Run, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT DISTINCT ON (command) `+runColumns+`
+		FROM public.ingest_runs
+		ORDER BY command, started_at DESC, id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	return scanRuns(rows)
+}
+
+func scanRuns(rows pgx.Rows) ([]*Run, error) {
+	defer rows.Close()
+	var runs []*Run
+	for rows.Next() {
+		r := &Run{}
+		var status string
+		err := rows.Scan(&r.ID, &r.RunID, &r.Command, &r.StartedAt, &r.FinishedAt, &r.From, &r.To,
+			&r.Fetched, &r.Inserted, &r.Skipped, &r.Failed, &r.Rejected, &r.HTTPStatus, &r.Error, &r.Version, &status)
+		if err != nil {
+			return nil, err
+		}
+		r.Status = parseStatus(status)
+		if r.From.Year() == 1 {
+			r.From, r.To = time.Time{}, time.Time{}
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+// Print writes the runs as a table.
+func Print(w io.Writer, runs []*Run) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tCOMMAND\tSTARTED\tDURATION\tDATES\tFETCHED\tINSERTED\tSKIPPED\tFAILED\tREJECTED\tHTTP\tVERSION\tOUTCOME")
+	for _, r := range runs {
+		dates, status := "-", "-"
+		if !r.From.IsZero() {
+			dates = r.From.Format("2006-01-02") + ".." + r.To.Format("2006-01-02")
+		}
+		if r.HTTPStatus != 0 {
+			status = fmt.Sprint(r.HTTPStatus)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%s\t%s\t%s\n",
+			r.ID, r.Command, r.StartedAt.Local().Format("2006-01-02 15:04:05"),
+			r.FinishedAt.Sub(r.StartedAt).Round(time.Second), dates,
+			r.Fetched, r.Inserted, r.Skipped, r.Failed, r.Rejected, status, r.Version, r.outcome())
+	}
+	tw.Flush()
+}
+
+// outcome is the status and the first line of the error, if any.
+func (r *Run) outcome() string {
+	if r.Error == "" {
+		if r.Status == StatusPartial {
+			return fmt.Sprintf("partial: %d rows failed, %d rejected", r.Failed, r.Rejected)
+		}
+		return r.Status.String()
+	}
+	msg, _, _ := strings.Cut(r.Error, "\n")
+	if len(msg) > 80 {
+		msg = msg[:77] + "..."
+	}
+	return r.Status.String() + ": " + msg
+}
+
+// BuildVersion is the version stored with every run: Version, or else what
+// the Go toolchain stamped into the binary.
+func BuildVersion() string {
+	if Version != "" {
+		return Version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	revision, dirty := "", false
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			dirty = s.Value == "true"
+		}
+	}
+	if revision == "" {
+		return "devel"
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if dirty {
+		revision += "-dirty"
+	}
+	return revision
+}
+
+func nullDate(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+func nullInt(n int) any {
+	if n == 0 {
+		return nil
+	}
+	return n
+}
+
+func nullString(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
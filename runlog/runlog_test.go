@@ -0,0 +1,212 @@
+package runlog
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunStatistics(t *testing.T) {
+	r := Start(context.Background(), "syncforex sync")
+	day := func(d int) time.Time { return time.Date(2024, 11, d, 0, 0, 0, 0, time.UTC) }
+	r.SetRange(day(12), day(14))
+	r.SetRange(day(10), day(13))
+	r.Add(5, 3, 1, 1)
+	r.Add(0, 2, 0, 0)
+	r.Fail(StatusDatabase, errors.New("gcloud: connection refused"))
+	r.Failf(StatusSource, "%s: timeout", "backup")
+
+	if !r.From.Equal(day(10)) || !r.To.Equal(day(14)) {
+		t.Errorf("range = %s..%s, want 2024-11-10..2024-11-14", r.From, r.To)
+	}
+	if r.Fetched != 5 || r.Inserted != 5 || r.Skipped != 1 || r.Failed != 1 {
+		t.Errorf("counts = %d/%d/%d/%d, want 5/5/1/1", r.Fetched, r.Inserted, r.Skipped, r.Failed)
+	}
+	if want := "gcloud: connection refused; backup: timeout"; r.Error != want {
+		t.Errorf("Error = %q, want %q", r.Error, want)
+	}
+	if r.Status != StatusDatabase {
+		t.Errorf("Status = %s, want the first failure, database_error", r.Status)
+	}
+	if r.Version == "" {
+		t.Error("Version is empty")
+	}
+}
+
+func TestNilRun(t *testing.T) {
+	var r *Run
+	r.SetRange(time.Now(), time.Now())
+	r.SetHTTPStatus(200)
+	r.Add(1, 1, 0, 0)
+	r.Failf(StatusFailed, "ignored")
+	r.NoData()
+	r.Reject("ignored")
+	r.Alert("ignored", "ignored", "")
+	r.Completed("ignored")
+	r.Finish()
+}
+
+func TestPrint(t *testing.T) {
+	start := time.Date(2024, 11, 15, 18, 0, 0, 0, time.Local)
+	runs := []*Run{
+		{ID: 2, Command: "maescraper", StartedAt: start, FinishedAt: start.Add(3 * time.Second),
+			From: start, To: start, Fetched: 12, Inserted: 12, HTTPStatus: 200, Version: "v1.0.0"},
+		{ID: 1, Command: "historicoforex", StartedAt: start, FinishedAt: start.Add(time.Minute),
+			HTTPStatus: 500, Error: "API returned status 500\nmore detail", Status: StatusSource, Version: "v1.0.0"},
+	}
+	var buf bytes.Buffer
+	Print(&buf, runs)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Print() wrote %d lines, want 3:\n%s", len(lines), buf.String())
+	}
+	for _, want := range []string{"maescraper", "2024-11-15..2024-11-15", "3s", "ok"} {
+		if !strings.Contains(lines[1], want) {
+			t.Errorf("line %q does not contain %q", lines[1], want)
+		}
+	}
+	if !strings.HasSuffix(lines[2], "source_error: API returned status 500") {
+		t.Errorf("line %q does not end with the first line of the error", lines[2])
+	}
+}
+
+func TestResult(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold string
+		run       *Run
+		want      Status
+	}{
+		{"all inserted", "", &Run{Inserted: 10}, StatusOK},
+		{"nothing fetched", "", &Run{Status: StatusNoData}, StatusNoData},
+		{"any failed row fails by default", "", &Run{Inserted: 99, Failed: 1}, StatusDatabase},
+		{"within fraction", "0.05", &Run{Inserted: 95, Failed: 5}, StatusPartial},
+		{"beyond percentage", "5%", &Run{Inserted: 94, Failed: 6}, StatusDatabase},
+		{"skipped rows count as attempted", "10%", &Run{Inserted: 5, Skipped: 5, Failed: 1}, StatusPartial},
+		{"explicit failure wins", "100%", &Run{Status: StatusSource, Failed: 1}, StatusSource},
+		{"invalid threshold is 0", "lots", &Run{Inserted: 99, Failed: 1}, StatusDatabase},
+		{"any rejected row fails by default", "", &Run{Inserted: 99, Rejected: 1}, StatusValidation},
+		{"rejections within threshold", "5%", &Run{Inserted: 95, Rejected: 3, Failed: 2}, StatusPartial},
+		{"rejections beyond threshold", "5%", &Run{Inserted: 90, Rejected: 6, Failed: 4}, StatusValidation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MAE_FAILURE_THRESHOLD", tt.threshold)
+			if got := tt.run.result(); got != tt.want {
+				t.Errorf("result() = %s (exit %d), want %s (exit %d)", got, got.ExitCode(), tt.want, tt.want.ExitCode())
+			}
+		})
+	}
+}
+
+func TestFindAlerts(t *testing.T) {
+	friday := time.Date(2024, 11, 15, 18, 0, 0, 0, time.UTC)
+	saturday := friday.AddDate(0, 0, 1)
+
+	r := Start(context.Background(), "maescraper")
+	r.StartedAt = saturday
+	r.NoData()
+	r.mu.Lock()
+	if alerts := r.findAlerts(); len(alerts) != 0 {
+		t.Errorf("no data on a Saturday raised %v", alerts)
+	}
+	r.StartedAt = friday
+	if alerts := r.findAlerts(); len(alerts) != 1 || alerts[0].Key != "no_data" {
+		t.Errorf("no data on a Friday raised %v, want no_data", alerts)
+	}
+	r.mu.Unlock()
+
+	r = Start(context.Background(), "maescraper")
+	for i := range 7 {
+		r.Reject(fmt.Sprintf("record %d: bad plazo", i))
+	}
+	r.Alert("lag:gcloud:public.forex", "public.forex in gcloud is 4 days behind", "")
+	r.Status = r.result()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	alerts := r.findAlerts()
+	var keys []string
+	for _, a := range alerts {
+		keys = append(keys, a.Key)
+	}
+	if got := strings.Join(keys, ","); got != "failed,rejected,lag:gcloud:public.forex" {
+		t.Fatalf("alert keys = %s", got)
+	}
+	if r.Rejected != 7 || r.Failed != 0 {
+		t.Errorf("Rejected, Failed = %d, %d, want 7, 0", r.Rejected, r.Failed)
+	}
+	if r.Status != StatusValidation {
+		t.Errorf("Status = %s (exit %d), want validation_error (exit 6)", r.Status, r.Status.ExitCode())
+	}
+	if !strings.HasSuffix(alerts[1].Text, "... and 2 more") {
+		t.Errorf("rejected text = %q, want 5 samples and a count", alerts[1].Text)
+	}
+}
+
+func TestSkip(t *testing.T) {
+	r := Start(context.Background(), "historicoforex")
+	r.Skip(errors.New("lock forex is held by pid 412"))
+	if r.Status != StatusSkipped || r.Status.ExitCode() != 7 || !r.Status.Succeeded() {
+		t.Errorf("Status = %s (exit %d), want skipped (exit 7), not a failure", r.Status, r.Status.ExitCode())
+	}
+	r.Failf(StatusDatabase, "connection lost")
+	if r.Status != StatusDatabase {
+		t.Errorf("Status = %s, a failure should override skipped", r.Status)
+	}
+	if parseStatus("skipped") != StatusSkipped {
+		t.Error("parseStatus(skipped) is not StatusSkipped")
+	}
+}
+
+func TestStatusForExitCode(t *testing.T) {
+	for s := range Status(len(exitCodes)) {
+		if got := StatusForExitCode(s.ExitCode()); got != s {
+			t.Errorf("StatusForExitCode(%d) = %s, want %s", s.ExitCode(), got, s)
+		}
+	}
+	if got := StatusForExitCode(137); got != StatusFailed {
+		t.Errorf("StatusForExitCode(137) = %s, want failed", got)
+	}
+}
+
+func TestInterrupted(t *testing.T) {
+	// Nowhere to record the run
+	t.Setenv("POSTGRES_DSN", "postgres://maescraper@127.0.0.1:1/forex?connect_timeout=1")
+	t.Setenv("MAE_ALERT_WEBHOOK_URL", "")
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	r := Start(ctx, "historicoforex")
+	r.Add(30, 20, 0, 0)
+	for i := 1; i <= 12; i++ {
+		r.Completed("2024-11-%02d: 10 filas", i)
+	}
+	cancel(errors.New("terminated signal received"))
+	r.Failf(StatusDatabase, "insert: context canceled")
+	r.Finish()
+
+	if r.Status != StatusInterrupted || r.Status.ExitCode() != 8 {
+		t.Errorf("Status = %s (exit %d), want interrupted (exit 8)", r.Status, r.Status.ExitCode())
+	}
+	if want := "terminated signal received; insert: context canceled"; r.Error != want {
+		t.Errorf("Error = %q, want %q", r.Error, want)
+	}
+	if alerts := r.findAlerts(); len(alerts) != 1 || alerts[0].Key != "interrupted" {
+		t.Errorf("findAlerts() = %+v, want one interrupted alert", alerts)
+	}
+
+	var buf bytes.Buffer
+	r.PrintSummary(&buf)
+	out := buf.String()
+	for _, want := range []string{"... y 2 más", "2024-11-03: 10 filas", "2024-11-12: 10 filas"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("summary does not contain %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "2024-11-02:") {
+		t.Errorf("summary lists more than %d units of work:\n%s", maxCompleted, out)
+	}
+}
@@ -0,0 +1,106 @@
+package runlog
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Status is the outcome of a run. Each has its own exit code, so cron,
+// systemd and schedulers can tell them apart.
+type Status int
+
+const (
+	StatusOK          Status = iota // everything fetched was written
+	StatusPartial                   // some rows failed, within MAE_FAILURE_THRESHOLD
+	StatusNoData                    // the source had nothing for the requested dates
+	StatusSkipped                   // another run held the lock, see package lock
+	StatusFailed                    // unexpected failure
+	StatusSource                    // the API could not be reached or answered with an error
+	StatusDatabase                  // the database could not be reached or rejected the rows
+	StatusValidation                // invalid configuration, or data that does not match the schema
+	StatusInterrupted               // stopped by SIGINT or SIGTERM before it was done
+)
+
+var statusNames = [...]string{"ok", "partial", "no_data", "skipped", "failed", "source_error", "database_error", "validation_error", "interrupted"}
+
+// Exit codes, by status
+var exitCodes = [...]int{0, 2, 3, 7, 1, 4, 5, 6, 8}
+
+func (s Status) String() string { return statusNames[s] }
+
+// ExitCode is the process exit status for the outcome:
+//
+//	0 ok, 1 failed, 2 partial, 3 no_data, 4 source_error,
+//	5 database_error, 6 validation_error, 7 skipped, 8 interrupted
+func (s Status) ExitCode() int { return exitCodes[s] }
+
+// StatusForExitCode is the status a command exited with, StatusFailed for
+// codes no status has (e.g. a crash).
+func StatusForExitCode(code int) Status {
+	for i, c := range exitCodes {
+		if c == code {
+			return Status(i)
+		}
+	}
+	return StatusFailed
+}
+
+// Succeeded tells whether the run did what it could: ok, partial, no_data or
+// skipped.
+func (s Status) Succeeded() bool { return s <= StatusSkipped }
+
+// parseStatus is the inverse of String, for runs read back from the table.
+func parseStatus(name string) Status {
+	for i, n := range statusNames {
+		if n == name {
+			return Status(i)
+		}
+	}
+	return StatusFailed
+}
+
+// failureThreshold is the fraction of rows that may fail, and the fraction
+// that may be rejected, while the run still counts as a partial success:
+// MAE_FAILURE_THRESHOLD as a fraction (0.05) or a percentage (5%). The
+// default, 0, makes any failed or rejected row a failure.
+func failureThreshold() float64 {
+	v := os.Getenv("MAE_FAILURE_THRESHOLD")
+	if v == "" {
+		return 0
+	}
+	s, percent := strings.CutSuffix(v, "%")
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if percent {
+		f /= 100
+	}
+	if err != nil || f < 0 || f > 1 {
+		slog.Warn("Invalid MAE_FAILURE_THRESHOLD, using 0", "value", v)
+		return 0
+	}
+	return f
+}
+
+// result is the final status: the first failure recorded, or else the
+// outcome of the row counts against the failure threshold. Rejected rows
+// beyond the threshold count as a validation error, failed rows as a
+// database error. Callers hold r.mu.
+func (r *Run) result() Status {
+	if !r.Status.Succeeded() || r.Failed+r.Rejected == 0 {
+		return r.Status
+	}
+	limit := failureThreshold() * float64(r.attempted())
+	switch {
+	case float64(r.Rejected) > limit:
+		return StatusValidation
+	case float64(r.Failed) > limit:
+		return StatusDatabase
+	}
+	return StatusPartial
+}
+
+// attempted is the number of rows the run tried to load. Callers hold r.mu.
+func (r *Run) attempted() int {
+	return r.Inserted + r.Skipped + r.Failed + r.Rejected
+}
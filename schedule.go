@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/jmtruffa/maescraper/config"
+	"github.com/jmtruffa/maescraper/metrics"
+	"github.com/jmtruffa/maescraper/runlog"
+	"github.com/jmtruffa/maescraper/scheduler"
+)
+
+const defaultSchedulerAddr = ":9110"
+
+// schedule runs the jobs of the configuration file until it is interrupted,
+// serving their state on GET /health and the metrics on GET /metrics at
+// MAE_SCHEDULER_ADDR (default :9110). Each run of a job is a child process of
+// this binary with the environment maescraper was started with, so the
+// settings of one job's profile never leak into another's.
+func schedule(ctx context.Context, opts options, env []string) {
+	path, profile := os.Getenv("MAE_CONFIG"), os.Getenv("MAE_PROFILE")
+	if path == "" {
+		fmt.Fprintln(os.Stderr, "schedule needs a configuration file with jobs")
+		os.Exit(runlog.StatusValidation.ExitCode())
+	}
+	f, err := config.Load(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(runlog.StatusValidation.ExitCode())
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(runlog.StatusFailed.ExitCode())
+	}
+
+	profiles := map[string]string{}
+	for _, j := range f.Jobs {
+		profiles[j.Name] = profile
+		if j.Profile != "" {
+			profiles[j.Name] = j.Profile
+		}
+		if _, err := f.Settings(profiles[j.Name]); err != nil {
+			fmt.Fprintf(os.Stderr, "job %s: %v\n", j.Name, err)
+			os.Exit(runlog.StatusValidation.ExitCode())
+		}
+	}
+	run := func(ctx context.Context, name string, args []string) (int, error) {
+		argv := append(childFlags(path, profiles[name], opts.settings), args...)
+		return runChild(ctx, exe, argv, env)
+	}
+	s, err := scheduler.New(f.Jobs, run, checkJobArgs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(runlog.StatusValidation.ExitCode())
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /health", s.Handler())
+	mux.Handle("GET /metrics", metrics.Handler())
+	addr := os.Getenv("MAE_SCHEDULER_ADDR")
+	if addr == "" {
+		addr = defaultSchedulerAddr
+	}
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.ListenAndServe() }()
+	slog.Info("Health endpoint listening", "addr", srv.Addr)
+
+	s.Start(ctx)
+	code := 0
+	select {
+	case <-ctx.Done():
+		slog.Info("Interrupted, stopping the running jobs")
+	case err := <-serveErr:
+		slog.Error("Health endpoint failed", "error", err)
+		code = runlog.StatusFailed.ExitCode()
+	}
+	s.Stop()
+	shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(shutdown)
+	if code != 0 {
+		os.Exit(code)
+	}
+}
+
+// checkJobArgs rejects the command of a job that would not run.
+func checkJobArgs(args []string) error {
+	_, command, _, err := parseArgs(args, io.Discard)
+	switch {
+	case errors.Is(err, flag.ErrHelp) || command == "schedule":
+		return fmt.Errorf("%s cannot be run as a job", args[0])
+	case err != nil:
+		return err
+	}
+	return nil
+}
+
+// childFlags are the flags that give a job's run the scheduler's
+// configuration file and -set flags, and the job's profile.
+func childFlags(path, profile string, s settings) []string {
+	argv := []string{"-config", path}
+	if profile != "" {
+		argv = append(argv, "-profile", profile)
+	}
+	names := make([]string, 0, len(s))
+	for k := range s {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		argv = append(argv, "-set", k+"="+s[k])
+	}
+	return argv
+}
+
+// runChild runs maescraper with the arguments and returns its exit code.
+// When ctx is done the child gets SIGTERM, so it can roll back and record
+// the run, and is killed if it has not exited a minute later.
+func runChild(ctx context.Context, exe string, argv, env []string) (int, error) {
+	cmd := exec.CommandContext(ctx, exe, argv...)
+	cmd.Env = env
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+	cmd.WaitDelay = time.Minute
+	err := cmd.Run()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() >= 0 {
+		return exit.ExitCode(), nil
+	}
+	return 0, err
+}
@@ -0,0 +1,363 @@
+// Package scheduler runs the jobs of the configuration file (see config.Job)
+// on cron schedules in Buenos Aires time, or after the jobs they depend on
+// succeed. Jobs are skipped on non-business days unless they say otherwise
+// (see calendar.BusinessDay), retried after retryable failures, and never
+// started while a previous run of theirs is still going.
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmtruffa/maescraper/calendar"
+	"github.com/jmtruffa/maescraper/config"
+	"github.com/jmtruffa/maescraper/runlog"
+	"github.com/robfig/cron/v3"
+)
+
+const defaultRetryDelay = 5 * time.Minute
+
+// Runner runs one attempt of a job with the given command arguments and
+// returns its exit code, see runlog.Status.ExitCode. It must stop the job
+// when ctx is done.
+type Runner func(ctx context.Context, name string, args []string) (int, error)
+
+// Job is a configured job and its state.
+type Job struct {
+	config.Job
+	args         []string
+	businessDays bool
+	retryDelay   time.Duration
+	timeout      time.Duration
+	schedule     cron.Schedule
+	dependents   []*Job
+
+	// Guarded by Scheduler.mu
+	state State
+}
+
+// State is what the health endpoint reports about a job.
+type State struct {
+	Name         string     `json:"name"`
+	Command      string     `json:"command"`
+	Schedule     string     `json:"schedule,omitempty"`
+	After        []string   `json:"after,omitempty"`
+	Running      bool       `json:"running"`
+	NextRun      *time.Time `json:"next_run,omitempty"`
+	LastStart    *time.Time `json:"last_start,omitempty"`
+	LastFinish   *time.Time `json:"last_finish,omitempty"`
+	LastStatus   string     `json:"last_status,omitempty"` // see runlog.Status
+	LastExitCode *int       `json:"last_exit_code,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	Attempts     int        `json:"attempts,omitempty"` // of the last run
+	LastSuccess  *time.Time `json:"last_success,omitempty"`
+	Failures     int        `json:"consecutive_failures"`
+}
+
+// Scheduler runs the jobs.
+type Scheduler struct {
+	jobs   []*Job
+	run    Runner
+	cron   *cron.Cron
+	now    func() time.Time
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu sync.Mutex
+}
+
+// New checks the jobs and returns a scheduler for them. check validates the
+// arguments of each job's command.
+func New(jobs []config.Job, run Runner, check func(args []string) error) (*Scheduler, error) {
+	if len(jobs) == 0 {
+		return nil, errors.New("no jobs configured")
+	}
+	s := &Scheduler{run: run, now: time.Now,
+		cron: cron.New(cron.WithLocation(calendar.BuenosAires), cron.WithLogger(cron.DiscardLogger))}
+	byName := map[string]*Job{}
+	for i, cj := range jobs {
+		j, err := newJob(cj, check)
+		if err != nil {
+			return nil, fmt.Errorf("job %d (%s): %w", i+1, cj.Name, err)
+		}
+		if byName[j.Name] != nil {
+			return nil, fmt.Errorf("duplicate job name %q", j.Name)
+		}
+		byName[j.Name] = j
+		s.jobs = append(s.jobs, j)
+	}
+	for _, j := range s.jobs {
+		for _, dep := range j.After {
+			d := byName[dep]
+			if d == nil {
+				return nil, fmt.Errorf("job %s: unknown job %q in after", j.Name, dep)
+			}
+			d.dependents = append(d.dependents, j)
+		}
+	}
+	for _, j := range s.jobs {
+		if path := cycle(j, nil); path != nil {
+			return nil, fmt.Errorf("jobs depend on each other: %s", strings.Join(path, " -> "))
+		}
+	}
+	return s, nil
+}
+
+func newJob(cj config.Job, check func([]string) error) (*Job, error) {
+	j := &Job{Job: cj, args: strings.Fields(cj.Command), businessDays: true, retryDelay: defaultRetryDelay}
+	j.state = State{Name: cj.Name, Command: cj.Command, Schedule: cj.Schedule, After: cj.After}
+	switch {
+	case j.Name == "":
+		return nil, errors.New("no name")
+	case len(j.args) == 0:
+		return nil, errors.New("no command")
+	case (j.Schedule == "") == (len(j.After) == 0):
+		return nil, errors.New("give either a schedule or the jobs it runs after")
+	case j.Retries < 0:
+		return nil, errors.New("negative retries")
+	}
+	if check != nil {
+		if err := check(j.args); err != nil {
+			return nil, err
+		}
+	}
+	if j.BusinessDays != nil {
+		j.businessDays = *j.BusinessDays
+	}
+	if j.Schedule != "" {
+		sched, err := cron.ParseStandard(j.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("schedule: %w", err)
+		}
+		j.schedule = sched
+	}
+	for _, d := range []struct {
+		value string
+		dst   *time.Duration
+		name  string
+	}{{j.RetryDelay, &j.retryDelay, "retry_delay"}, {j.Timeout, &j.timeout, "timeout"}} {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("invalid %s %q", d.name, d.value)
+		}
+		*d.dst = v
+	}
+	return j, nil
+}
+
+// cycle returns the path of a dependency cycle through j, if any.
+func cycle(j *Job, path []string) []string {
+	if slices.Contains(path, j.Name) {
+		return append(path, j.Name)
+	}
+	path = append(path, j.Name)
+	for _, d := range j.dependents {
+		if c := cycle(d, path); c != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// Start schedules the jobs. Jobs are stopped when ctx is done.
+func (s *Scheduler) Start(ctx context.Context) {
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	for _, j := range s.jobs {
+		if j.schedule == nil {
+			continue
+		}
+		s.cron.Schedule(j.schedule, cron.FuncJob(func() { s.trigger(j, "schedule") }))
+	}
+	s.cron.Start()
+	slog.Info("Scheduler started", "jobs", len(s.jobs))
+}
+
+// Stop stops scheduling, stops the running jobs and waits for them.
+func (s *Scheduler) Stop() {
+	<-s.cron.Stop().Done()
+	s.cancel()
+	s.wg.Wait()
+	slog.Info("Scheduler stopped")
+}
+
+// trigger starts a run of the job unless it is running already or today is
+// not a business day for it.
+func (s *Scheduler) trigger(j *Job, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	log := slog.With("job", j.Name, "reason", reason)
+	switch {
+	case s.ctx.Err() != nil:
+		return
+	case j.state.Running:
+		log.Warn("Job still running, not started again")
+		return
+	case j.businessDays && !calendar.BusinessDay(s.now()):
+		log.Info("Not a business day, job not started")
+		return
+	}
+	start := s.now()
+	j.state.Running = true
+	j.state.LastStart = &start
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.execute(j, log)
+	}()
+}
+
+// execute runs the job, retrying retryable failures, and then starts the
+// jobs waiting for it.
+func (s *Scheduler) execute(j *Job, log *slog.Logger) {
+	var status runlog.Status
+	var code, attempt int
+	var err error
+	for attempt = 1; ; attempt++ {
+		log.Info("Starting job", "attempt", attempt, "command", j.Command)
+		code, err = s.attempt(j)
+		status = statusOf(code, err)
+		if err != nil {
+			log.Error("Job failed to run", "attempt", attempt, "error", err)
+		} else {
+			log.Info("Job finished", "attempt", attempt, "status", status.String(), "exit_code", code)
+		}
+		if !retryable(status) || attempt > j.Retries {
+			break
+		}
+		log.Info("Retrying job", "delay", j.retryDelay)
+		select {
+		case <-s.ctx.Done():
+		case <-time.After(j.retryDelay):
+		}
+		if s.ctx.Err() != nil {
+			break
+		}
+	}
+
+	s.mu.Lock()
+	finish := s.now()
+	j.state.Running = false
+	j.state.LastFinish = &finish
+	j.state.LastStatus = status.String()
+	j.state.LastExitCode = &code
+	j.state.LastError = ""
+	if err != nil {
+		j.state.LastError = err.Error()
+	}
+	j.state.Attempts = attempt
+	succeeded := loaded(status)
+	if succeeded {
+		j.state.LastSuccess = &finish
+		j.state.Failures = 0
+	} else if !status.Succeeded() {
+		j.state.Failures++
+	}
+	var ready []*Job
+	if succeeded {
+		for _, d := range j.dependents {
+			if s.depsDone(d) {
+				ready = append(ready, d)
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	for _, d := range ready {
+		s.trigger(d, "after "+j.Name)
+	}
+}
+
+func (s *Scheduler) attempt(j *Job) (int, error) {
+	ctx, cancel := s.ctx, context.CancelFunc(func() {})
+	if j.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, j.timeout)
+	}
+	defer cancel()
+	return s.run(ctx, j.Name, j.args)
+}
+
+// depsDone tells whether every job d runs after has succeeded since d last
+// started. Callers hold s.mu.
+func (s *Scheduler) depsDone(d *Job) bool {
+	for _, j := range s.jobs {
+		if !slices.Contains(d.After, j.Name) {
+			continue
+		}
+		if j.state.LastSuccess == nil || (d.state.LastStart != nil && j.state.LastSuccess.Before(*d.state.LastStart)) {
+			return false
+		}
+	}
+	return true
+}
+
+// statusOf is the outcome of an attempt from its exit code.
+func statusOf(code int, err error) runlog.Status {
+	if err != nil {
+		return runlog.StatusFailed
+	}
+	return runlog.StatusForExitCode(code)
+}
+
+// retryable tells whether another attempt might succeed: not for invalid
+// configuration or data, nor when another run holds the lock.
+func retryable(s runlog.Status) bool {
+	return s == runlog.StatusFailed || s == runlog.StatusSource || s == runlog.StatusDatabase
+}
+
+// loaded tells whether a run did its work, so the jobs after it may start.
+func loaded(s runlog.Status) bool {
+	return s.Succeeded() && s != runlog.StatusSkipped
+}
+
+// State returns the state of every job.
+func (s *Scheduler) State() []State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	states := make([]State, len(s.jobs))
+	for i, j := range s.jobs {
+		states[i] = j.state
+		if j.schedule != nil {
+			next := j.schedule.Next(s.now().In(calendar.BuenosAires))
+			states[i].NextRun = &next
+		}
+	}
+	return states
+}
+
+// Healthy tells whether the last run of every job that ran succeeded.
+func (s *Scheduler) Healthy() bool {
+	for _, st := range s.State() {
+		if st.Failures > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Handler serves GET /health: the state of every job as JSON, with status
+// 200 when Healthy and 503 otherwise.
+func (s *Scheduler) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
+		status, code := "ok", http.StatusOK
+		if !s.Healthy() {
+			status, code = "failing", http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(map[string]any{"status": status, "jobs": s.State()})
+	})
+	return mux
+}
@@ -0,0 +1,157 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmtruffa/maescraper/config"
+)
+
+// fakeRunner returns the given exit codes for each job in turn, 0 once they
+// run out, and records the calls.
+type fakeRunner struct {
+	mu    sync.Mutex
+	codes map[string][]int
+	calls []string
+}
+
+func (f *fakeRunner) run(_ context.Context, name string, args []string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, name+":"+strings.Join(args, " "))
+	codes := f.codes[name]
+	if len(codes) == 0 {
+		return 0, nil
+	}
+	f.codes[name] = codes[1:]
+	return codes[0], nil
+}
+
+var friday = time.Date(2024, 11, 15, 17, 30, 0, 0, time.UTC)
+
+func newTest(t *testing.T, jobs []config.Job, codes map[string][]int, now time.Time) (*Scheduler, *fakeRunner) {
+	t.Helper()
+	f := &fakeRunner{codes: codes}
+	s, err := New(jobs, f.run, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A clock that ticks, so runs are ordered in time
+	var mu sync.Mutex
+	s.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(time.Second)
+		return now
+	}
+	s.Start(context.Background())
+	t.Cleanup(s.Stop)
+	return s, f
+}
+
+func pipeline() []config.Job {
+	return []config.Job{
+		{Name: "fetch", Command: "fetch", Schedule: "30 17 * * 1-5", Retries: 2, RetryDelay: "1ms"},
+		{Name: "backfill", Command: "backfill", Schedule: "@daily"},
+		{Name: "sync", Command: "sync cdc", After: []string{"fetch", "backfill"}},
+	}
+}
+
+func TestRetriesAndDependencies(t *testing.T) {
+	s, f := newTest(t, pipeline(), map[string][]int{"fetch": {5, 4}}, friday)
+	s.trigger(s.jobs[1], "test")
+	s.wg.Wait()
+	s.trigger(s.jobs[0], "test")
+	s.wg.Wait()
+
+	want := "backfill:backfill fetch:fetch fetch:fetch fetch:fetch sync:sync cdc"
+	if got := strings.Join(f.calls, " "); got != want {
+		t.Errorf("calls = %s, want %s", got, want)
+	}
+	st := s.State()
+	if st[0].Attempts != 3 || st[0].LastStatus != "ok" || st[0].Failures != 0 {
+		t.Errorf("fetch state = %+v, want ok after 3 attempts", st[0])
+	}
+	if st[0].NextRun == nil || st[2].NextRun != nil {
+		t.Error("only scheduled jobs have a next run")
+	}
+
+	// sync waits for both again
+	s.trigger(s.jobs[0], "test")
+	s.wg.Wait()
+	if n := len(f.calls); n != 6 {
+		t.Errorf("sync ran again before backfill did: %v", f.calls)
+	}
+}
+
+func TestNoRetry(t *testing.T) {
+	s, f := newTest(t, pipeline(), map[string][]int{"fetch": {6}, "backfill": {0}}, friday)
+	s.trigger(s.jobs[1], "test")
+	s.wg.Wait()
+	s.trigger(s.jobs[0], "test")
+	s.wg.Wait()
+
+	if got := strings.Join(f.calls, " "); got != "backfill:backfill fetch:fetch" {
+		t.Errorf("calls = %s, want a single attempt at fetch and no sync", got)
+	}
+	if s.Healthy() {
+		t.Error("Healthy() after a validation error")
+	}
+
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	var body struct {
+		Status string  `json:"status"`
+		Jobs   []State `json:"jobs"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusServiceUnavailable || body.Status != "failing" || body.Jobs[0].LastStatus != "validation_error" {
+		t.Errorf("GET /health = %d %+v", rec.Code, body)
+	}
+}
+
+func TestBusinessDays(t *testing.T) {
+	no := false
+	jobs := []config.Job{
+		{Name: "fetch", Command: "fetch", Schedule: "@daily"},
+		{Name: "runs", Command: "runs 5", Schedule: "@daily", BusinessDays: &no},
+	}
+	s, f := newTest(t, jobs, nil, friday.AddDate(0, 0, 1))
+	s.trigger(s.jobs[0], "test")
+	s.trigger(s.jobs[1], "test")
+	s.wg.Wait()
+	if got := strings.Join(f.calls, " "); got != "runs:runs 5" {
+		t.Errorf("calls on a Saturday = %s, want only the job not limited to business days", got)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	tests := map[string][]config.Job{
+		"no jobs":            nil,
+		"both":               {{Name: "a", Command: "fetch", Schedule: "@daily", After: []string{"a"}}},
+		"neither":            {{Name: "a", Command: "fetch"}},
+		"no command":         {{Name: "a", Schedule: "@daily"}},
+		"bad schedule":       {{Name: "a", Command: "fetch", Schedule: "at noon"}},
+		"bad retry delay":    {{Name: "a", Command: "fetch", Schedule: "@daily", RetryDelay: "soon"}},
+		"duplicate":          {{Name: "a", Command: "fetch", Schedule: "@daily"}, {Name: "a", Command: "sync", Schedule: "@daily"}},
+		"unknown dependency": {{Name: "a", Command: "fetch", After: []string{"b"}}},
+		"cycle": {
+			{Name: "a", Command: "fetch", Schedule: "@daily"},
+			{Name: "b", Command: "sync", After: []string{"a", "c"}},
+			{Name: "c", Command: "sync", After: []string{"b"}},
+		},
+	}
+	for name, jobs := range tests {
+		if _, err := New(jobs, nil, nil); err == nil {
+			t.Errorf("%s: New() succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Package secrets reads the credentials of maescraper: the API key, database
+// passwords and DSNs, and the ingest token. A secret named e.g.
+// POSTGRES_PASSWORD is looked up, in order, in
+//
+//	POSTGRES_PASSWORD       the environment variable itself
+//	POSTGRES_PASSWORD_FILE  a file holding it, e.g. a Docker or Kubernetes secret
+//	$MAE_SECRETS_DIR/POSTGRES_PASSWORD
+//	                        a file named after it in a mounted secrets directory
+//	$MAE_SECRETS_COMMAND POSTGRES_PASSWORD
+//	                        the output of a helper, e.g. one reading a vault
+//
+// and then in the providers added with Register. Every value returned is
+// remembered so Redact can hide it from logs and error messages.
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Provider looks up secrets by name.
+type Provider interface {
+	// Secret returns the named secret; ok is false when the provider does
+	// not have it.
+	Secret(name string) (value string, ok bool, err error)
+}
+
+// ProviderFunc adapts a function to Provider.
+type ProviderFunc func(name string) (string, bool, error)
+
+func (f ProviderFunc) Secret(name string) (string, bool, error) { return f(name) }
+
+var (
+	mu        sync.Mutex
+	providers = []Provider{ProviderFunc(fromEnv), ProviderFunc(fromDir), ProviderFunc(fromCommand)}
+	known     = map[string]bool{}
+)
+
+// Register adds a provider, consulted after the built-in ones.
+func Register(p Provider) {
+	mu.Lock()
+	defer mu.Unlock()
+	providers = append(providers, p)
+}
+
+// Get returns the named secret, "" when no provider has it.
+func Get(name string) (string, error) {
+	mu.Lock()
+	ps := providers
+	mu.Unlock()
+	for _, p := range ps {
+		v, ok, err := p.Secret(name)
+		if err != nil {
+			return "", fmt.Errorf("secret %s: %w", name, err)
+		}
+		if ok && v != "" {
+			remember(v)
+			return v, nil
+		}
+	}
+	return "", nil
+}
+
+// remember records a value for Redact. Very short values would redact
+// unrelated text, so they are not.
+func remember(v string) {
+	if len(v) < 4 {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	known[v] = true
+}
+
+// fromEnv reads NAME, or the file named by NAME_FILE.
+func fromEnv(name string) (string, bool, error) {
+	v := os.Getenv(name)
+	path := os.Getenv(name + "_FILE")
+	switch {
+	case v != "" && path != "":
+		return "", false, fmt.Errorf("both %s and %s_FILE are set", name, name)
+	case path != "":
+		return readFile(path)
+	}
+	return v, v != "", nil
+}
+
+// fromDir reads $MAE_SECRETS_DIR/NAME, if it exists.
+func fromDir(name string) (string, bool, error) {
+	dir := os.Getenv("MAE_SECRETS_DIR")
+	if dir == "" {
+		return "", false, nil
+	}
+	v, ok, err := readFile(filepath.Join(dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false, nil
+	}
+	return v, ok, err
+}
+
+func readFile(path string) (string, bool, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, err
+	}
+	v := strings.TrimRight(string(body), "\r\n")
+	return v, v != "", nil
+}
+
+// fromCommand runs MAE_SECRETS_COMMAND with the name as its last argument.
+// The secret is its output; no output means it has no such secret.
+func fromCommand(name string) (string, bool, error) {
+	command := strings.Fields(os.Getenv("MAE_SECRETS_COMMAND"))
+	if len(command) == 0 {
+		return "", false, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command[0], append(command[1:], name)...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		// Only the first line of stderr, in case the helper is chatty
+		msg, _, _ := strings.Cut(strings.TrimSpace(stderr.String()), "\n")
+		return "", false, fmt.Errorf("%s: %v %s", command[0], err, msg)
+	}
+	v := strings.TrimRight(stdout.String(), "\r\n")
+	return v, v != "", nil
+}
+
+// Placeholder replaces secrets in redacted text.
+const Placeholder = "*****"
+
+// Credentials in connection strings: the password of a URL and the password
+// keyword of the key=value form.
+var (
+	urlPassword     = regexp.MustCompile(`(://[^:/@\s]*:)[^@\s]*@`)
+	keywordPassword = regexp.MustCompile(`(?i)(password\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+)
+
+// Redact hides the secrets returned by Get, and passwords in connection
+// strings, in s.
+func Redact(s string) string {
+	mu.Lock()
+	values := make([]string, 0, len(known))
+	for v := range known {
+		values = append(values, v)
+	}
+	mu.Unlock()
+	// Longest first, so a secret containing another is hidden whole
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	for _, v := range values {
+		s = strings.ReplaceAll(s, v, Placeholder)
+	}
+	s = urlPassword.ReplaceAllString(s, "${1}"+Placeholder+"@")
+	return keywordPassword.ReplaceAllString(s, "${1}"+Placeholder)
+}
@@ -0,0 +1,76 @@
+package secrets
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, body string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(body), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	secretsDir := filepath.Join(dir, "mounted")
+	os.Mkdir(secretsDir, 0o700)
+	os.WriteFile(filepath.Join(secretsDir, "REPLICA_PASSWORD"), []byte("from-dir\n"), 0o600)
+	helper := write("helper.sh", "#!/bin/sh\n[ \"$1\" = SYNC_INGEST_TOKEN ] && echo from-command\nexit 0\n")
+
+	t.Setenv("POSTGRES_PASSWORD", "from-env")
+	t.Setenv("GCLOUD_POSTGRES_PASSWORD_FILE", write("gcloud", "from-file\r\n"))
+	t.Setenv("MAE_SECRETS_DIR", secretsDir)
+	t.Setenv("MAE_SECRETS_COMMAND", helper)
+
+	for name, want := range map[string]string{
+		"POSTGRES_PASSWORD":        "from-env",
+		"GCLOUD_POSTGRES_PASSWORD": "from-file",
+		"REPLICA_PASSWORD":         "from-dir",
+		"SYNC_INGEST_TOKEN":        "from-command",
+		"MAE_API_KEY":              "",
+	} {
+		got, err := Get(name)
+		if err != nil || got != want {
+			t.Errorf("Get(%s) = %q, %v, want %q", name, got, err, want)
+		}
+	}
+
+	Register(ProviderFunc(func(name string) (string, bool, error) { return "registered", name == "MAE_API_KEY", nil }))
+	if got, _ := Get("MAE_API_KEY"); got != "registered" {
+		t.Errorf("Get(MAE_API_KEY) = %q, want it from the registered provider", got)
+	}
+
+	t.Setenv("POSTGRES_PASSWORD_FILE", filepath.Join(dir, "gcloud"))
+	if _, err := Get("POSTGRES_PASSWORD"); err == nil {
+		t.Error("Get() accepted both POSTGRES_PASSWORD and POSTGRES_PASSWORD_FILE")
+	}
+	t.Setenv("POSTGRES_PASSWORD", "")
+	t.Setenv("POSTGRES_PASSWORD_FILE", filepath.Join(dir, "missing"))
+	if _, err := Get("POSTGRES_PASSWORD"); err == nil || !strings.Contains(err.Error(), "POSTGRES_PASSWORD") {
+		t.Errorf("Get() with a missing file = %v, want an error naming the secret", err)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	t.Setenv("MAE_SECRETS_DIR", "")
+	t.Setenv("MAE_SECRETS_COMMAND", "")
+	t.Setenv("MAE_API_KEY", "k3y-abc123")
+	if _, err := Get("MAE_API_KEY"); err != nil {
+		t.Fatal(err)
+	}
+	for in, want := range map[string]string{
+		"request with x-api-key k3y-abc123 failed":       "request with x-api-key ***** failed",
+		"postgres://sync:p%40ss@db:5432/forex":           "postgres://sync:*****@db:5432/forex",
+		"host=db user=sync password='p ss' dbname=forex": "host=db user=sync password=***** dbname=forex",
+		"host=db password=secret":                        "host=db password=*****",
+		"nothing to hide in 2024-11-15":                  "nothing to hide in 2024-11-15",
+	} {
+		if got := Redact(in); got != want {
+			t.Errorf("Redact(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jmtruffa/maescraper/dbconfig"
+	"github.com/jmtruffa/maescraper/internal/forex"
+	"github.com/jmtruffa/maescraper/metrics"
+	"github.com/jmtruffa/maescraper/runlog"
+)
+
+// spoolVersion is written into every spool file so the format can change
+// without replaying old files wrongly.
+const spoolVersion = 1
+
+// spoolFile is a batch of rows that could not be written to the database.
+type spoolFile struct {
+	Version   int         `json:"version"`
+	CreatedAt time.Time   `json:"created_at"`
+	Rows      []forex.Row `json:"rows"`
+}
+
+// spoolDir is where rows are kept while the database is unavailable:
+// MAE_SPOOL_DIR, or maescraper/spool under the user cache directory.
+func spoolDir() string {
+	if dir := os.Getenv("MAE_SPOOL_DIR"); dir != "" {
+		return dir
+	}
+	if cache, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(cache, "maescraper", "spool")
+	}
+	return "spool"
+}
+
+// spoolRows durably writes the rows to a new file in the spool directory.
+// The file is written under a temporary name, synced and then renamed, so
+// a crash never leaves a partial file to be replayed.
+func spoolRows(dir string, rows []forex.Row) (string, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(spoolFile{Version: spoolVersion, CreatedAt: time.Now().UTC(), Rows: rows})
+	if err != nil {
+		return "", err
+	}
+
+	tmp, err := os.CreateTemp(dir, ".forex-*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	// Names sort in creation order
+	name := filepath.Join(dir, fmt.Sprintf("forex-%s-%d.json", time.Now().UTC().Format("20060102T150405.000000000"), os.Getpid()))
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return "", err
+	}
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return name, nil
+}
+
+// spooledFiles lists the spool files, oldest first.
+func spooledFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "forex-*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func readSpool(path string) ([]forex.Row, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f spoolFile
+	if err := json.Unmarshal(body, &f); err != nil {
+		return nil, err
+	}
+	if f.Version != spoolVersion {
+		return nil, fmt.Errorf("unsupported spool version %d", f.Version)
+	}
+	for i := range f.Rows {
+		// A missing extra_fields comes back as the JSON literal null
+		if string(f.Rows[i].ExtraFields) == "null" {
+			f.Rows[i].ExtraFields = nil
+		}
+	}
+	return f.Rows, nil
+}
+
+// flushSpool replays every spool file into the database, oldest first. Rows
+// already present are left alone (ON CONFLICT DO NOTHING on the natural key),
+// so a file replayed twice does no harm. Each file is inserted in one
+// transaction and removed once committed. Files that cannot be read, or that
+// the database rejects for a reason other than the connection, would fail
+// every replay and hold back the files after them: they are renamed to *.bad,
+// kept for inspection and alerted on through run. When ctx is done or the
+// connection fails the file being replayed is rolled back and kept, with the
+// rest.
+func flushSpool(ctx context.Context, conn *pgx.Conn, dir string, run *runlog.Run) (int, error) {
+	files, err := spooledFiles(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, path := range files {
+		rows, err := readSpool(path)
+		if err != nil {
+			moveAside(path, fmt.Errorf("unreadable: %w", err), run)
+			continue
+		}
+
+		start := time.Now()
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return total, err
+		}
+		inserted := 0
+		for _, row := range rows {
+			var tag pgconn.CommandTag
+			tag, err = tx.Exec(ctx, forex.InsertQuery+" ON CONFLICT (date, rueda, instrumento) DO NOTHING", row.Values()...)
+			if err != nil {
+				err = fmt.Errorf("replay %s (instrumento=%s): %w", filepath.Base(path), row.Instrumento, err)
+				break
+			}
+			inserted += int(tag.RowsAffected())
+		}
+		if err != nil {
+			dbconfig.Rollback(ctx, tx)
+			if ctx.Err() != nil || isConnectionError(err) {
+				return total, err
+			}
+			moveAside(path, err, run)
+			continue
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return total, fmt.Errorf("replay %s: %w", filepath.Base(path), err)
+		}
+		metrics.ObserveDBWrite("maescraper", "spool_replay", start)
+		if err := os.Remove(path); err != nil {
+			return total, err
+		}
+		slog.Info("Replayed spool file", "file", filepath.Base(path), "inserted", inserted, "rows", len(rows))
+		total += inserted
+	}
+	return total, nil
+}
+
+// moveAside renames a spool file that cannot be replayed to *.bad, so it no
+// longer blocks the spool, and raises an alert for it.
+func moveAside(path string, reason error, run *runlog.Run) {
+	bad := strings.TrimSuffix(path, ".json") + ".bad"
+	slog.Error("Spool file cannot be replayed, moving it aside", "path", path, "moved_to", bad, "error", reason)
+	if err := os.Rename(path, bad); err != nil {
+		slog.Error("Unable to move spool file aside", "path", path, "error", err)
+	}
+	run.Alert("spool:"+filepath.Base(path), "Spool file "+filepath.Base(path)+" moved aside",
+		fmt.Sprintf("%v. The rows are kept in %s.", reason, bad))
+}
+
+// isConnectionError tells whether a database error means the server could
+// not be reached or went away, as opposed to the server rejecting the data.
+// Only the former is worth spooling and retrying.
+func isConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && len(pgErr.Code) == 5 {
+		// Connection exception, insufficient resources, operator intervention
+		class := pgErr.Code[:2]
+		return class == "08" || class == "53" || class == "57"
+	}
+	return true
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jmtruffa/maescraper/internal/forex"
+)
+
+func TestSpoolRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	settle := 0
+	rows := []forex.Row{
+		{Date: time.Date(2024, 11, 15, 0, 0, 0, 0, time.UTC), Rueda: "CAM1", Instrumento: "USB / ART 000", Settle: &settle},
+		{Date: time.Date(2024, 11, 15, 0, 0, 0, 0, time.UTC), Rueda: "CAM2", Instrumento: "USMEP / ART 000", ExtraFields: json.RawMessage(`{"nuevo":1}`)},
+	}
+
+	first, err := spoolRows(dir, rows[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := spoolRows(dir, rows[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := spooledFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(files, []string{first, second}) {
+		t.Fatalf("spooledFiles = %v, want %v", files, []string{first, second})
+	}
+
+	var got []forex.Row
+	for _, f := range files {
+		r, err := readSpool(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, r...)
+	}
+	if !reflect.DeepEqual(got, rows) {
+		t.Errorf("readSpool = %+v, want %+v", got, rows)
+	}
+}
+
+func TestReadSpoolVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "forex-old.json")
+	if err := os.WriteFile(path, []byte(`{"version":99,"rows":[]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readSpool(path); err == nil {
+		t.Error("expected an error for an unknown spool version")
+	}
+}
+
+func TestMoveAside(t *testing.T) {
+	dir := t.TempDir()
+	path, err := spoolRows(dir, []forex.Row{{Date: time.Date(2024, 11, 15, 0, 0, 0, 0, time.UTC), Rueda: "CAM1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	moveAside(path, errors.New("value too long"), nil)
+
+	files, err := spooledFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("spooledFiles = %v, want none left to replay", files)
+	}
+	if _, err := os.Stat(strings.TrimSuffix(path, ".json") + ".bad"); err != nil {
+		t.Errorf("moved file: %v", err)
+	}
+}
+
+func TestIsConnectionError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("dial tcp: connection refused"), true},
+		{&pgconn.PgError{Code: "08006"}, true},
+		{&pgconn.PgError{Code: "57P01"}, true},
+		{&pgconn.PgError{Code: "23505"}, false},
+		{&pgconn.PgError{Code: "22P02"}, false},
+	}
+	for _, tt := range tests {
+		if got := isConnectionError(tt.err); got != tt.want {
+			t.Errorf("isConnectionError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+-- ISO 4217 currency columns and settlement type for public.forex.
+-- The legacy currency_out/currency_in columns are kept unchanged.
+-- Apply to both the local (forex3) and cloud (forex) databases.
+
+ALTER TABLE public.forex
+    ADD COLUMN IF NOT EXISTS iso_currency_out text,
+    ADD COLUMN IF NOT EXISTS iso_currency_in  text,
+    ADD COLUMN IF NOT EXISTS settlement_type  text;
+
+-- Backfill existing rows. Mirrors currencyOutMappings/currencyInMappings in internal/forex/currency.go.
+UPDATE public.forex f
+SET iso_currency_out = m.iso,
+    settlement_type  = m.settlement_type
+FROM (VALUES
+    ('USB',   'USD', 'billete'),
+    ('MB',    'USD', 'transferencia'),
+    ('USMEP', 'USD', 'MEP'),
+    ('UBMEP', 'USD', 'MEP')
+) AS m (currency_out, iso, settlement_type)
+WHERE f.currency_out = m.currency_out
+  AND f.iso_currency_out IS NULL;
+
+UPDATE public.forex
+SET iso_currency_in = 'ARS'
+WHERE currency_in = 'ART'
+  AND iso_currency_in IS NULL;
@@ -0,0 +1,34 @@
+-- Instrument master maintained by maescraper and historicoforex.
+-- One row per (ticker, codigo_segmento) with the current metadata, plus a
+-- slowly-changing history of every version of that metadata.
+
+CREATE TABLE IF NOT EXISTS public.forex_instruments (
+    ticker          text        NOT NULL,
+    codigo_segmento text        NOT NULL,
+    segmento        text,
+    descripcion     text,
+    tipo_emision    text,
+    moneda          text,
+    first_seen      date        NOT NULL,
+    last_seen       date        NOT NULL,
+    active          boolean     NOT NULL DEFAULT true,
+    updated_at      timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (ticker, codigo_segmento)
+);
+
+-- valid_to is NULL for the current version.
+CREATE TABLE IF NOT EXISTS public.forex_instruments_history (
+    id              bigserial   PRIMARY KEY,
+    ticker          text        NOT NULL,
+    codigo_segmento text        NOT NULL,
+    segmento        text,
+    descripcion     text,
+    tipo_emision    text,
+    moneda          text,
+    valid_from      date        NOT NULL,
+    valid_to        date,
+    recorded_at     timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS forex_instruments_history_key_idx
+    ON public.forex_instruments_history (ticker, codigo_segmento, valid_from);
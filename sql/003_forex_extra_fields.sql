@@ -0,0 +1,5 @@
+-- Fields returned by the MAE API that the scrapers do not map to a column.
+-- Apply to both the local (forex3) and cloud (forex) databases.
+
+ALTER TABLE public.forex
+    ADD COLUMN IF NOT EXISTS extra_fields jsonb;
@@ -0,0 +1,10 @@
+-- Sync progress kept by syncforex on the destination (cloud) database.
+-- One row per table and date that was copied completely, with its row count.
+
+CREATE TABLE IF NOT EXISTS public.sync_state (
+    table_name text        NOT NULL,
+    date       date        NOT NULL,
+    row_count  bigint      NOT NULL,
+    synced_at  timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (table_name, date)
+);
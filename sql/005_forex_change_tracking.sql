@@ -0,0 +1,19 @@
+-- Change tracking on public.forex for syncforex's cdc mode: the natural key
+-- index and the change cursor, for both databases. The cloud side needs the
+-- index to upsert. The timestamps, deletion log and triggers of the local
+-- (forex3) database, which is the source of changes, are in 011.
+--
+-- The unique index fails if duplicate rows already exist; find them with
+--   SELECT date, rueda, instrumento, COUNT(*) FROM public.forex
+--   GROUP BY 1, 2, 3 HAVING COUNT(*) > 1;
+
+CREATE UNIQUE INDEX IF NOT EXISTS forex_natural_key
+    ON public.forex (date, rueda, instrumento);
+
+-- Change cursor kept by syncforex on the destination (cloud) database.
+CREATE TABLE IF NOT EXISTS public.sync_cursor (
+    table_name text        PRIMARY KEY,
+    changed_at timestamptz NOT NULL,
+    deleted_at timestamptz NOT NULL,
+    synced_at  timestamptz NOT NULL DEFAULT now()
+);
@@ -0,0 +1,20 @@
+-- One row per run of maescraper, historicoforex and syncforex, written by
+-- the runlog package when the run ends. List them with `maescraper runs`.
+CREATE TABLE IF NOT EXISTS public.ingest_runs (
+    id            bigserial   PRIMARY KEY,
+    command       text        NOT NULL,
+    started_at    timestamptz NOT NULL,
+    finished_at   timestamptz NOT NULL,
+    date_from     date,
+    date_to       date,
+    rows_fetched  integer     NOT NULL DEFAULT 0,
+    rows_inserted integer     NOT NULL DEFAULT 0,
+    rows_skipped  integer     NOT NULL DEFAULT 0,
+    rows_failed   integer     NOT NULL DEFAULT 0,
+    http_status   integer,
+    error         text,
+    version       text        NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS ingest_runs_started_at_idx
+    ON public.ingest_runs (started_at DESC);
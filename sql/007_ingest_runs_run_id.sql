@@ -0,0 +1,6 @@
+-- Run id of each run, as logged in the run_id field of every log record.
+ALTER TABLE public.ingest_runs
+    ADD COLUMN IF NOT EXISTS run_id text;
+
+CREATE INDEX IF NOT EXISTS ingest_runs_run_id_idx
+    ON public.ingest_runs (run_id);
@@ -0,0 +1,5 @@
+-- Outcome of each run and the exit code it ended with, see runlog.Status:
+-- ok, partial, no_data, failed, source_error, database_error or validation_error.
+ALTER TABLE public.ingest_runs
+    ADD COLUMN IF NOT EXISTS status    text,
+    ADD COLUMN IF NOT EXISTS exit_code integer;
@@ -0,0 +1,12 @@
+-- Holder of each advisory lock taken by the lock package, so a run that is
+-- skipped because the lock is taken can report which run holds it. Rows are
+-- removed when the lock is released; a row whose pid no longer holds the lock
+-- is stale and ignored. Apply to both the local (forex3) and cloud (forex)
+-- databases.
+CREATE TABLE IF NOT EXISTS public.run_locks (
+    name        text        PRIMARY KEY,
+    run_id      text        NOT NULL,
+    command     text        NOT NULL,
+    pid         integer     NOT NULL,
+    acquired_at timestamptz NOT NULL DEFAULT now()
+);
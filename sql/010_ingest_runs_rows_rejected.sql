@@ -0,0 +1,4 @@
+-- Rows rejected by validation, counted apart from rows_failed (rows the
+-- database did not take), see runlog.Run.Reject.
+ALTER TABLE public.ingest_runs
+    ADD COLUMN IF NOT EXISTS rows_rejected integer NOT NULL DEFAULT 0;
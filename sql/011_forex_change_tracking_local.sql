@@ -0,0 +1,55 @@
+-- target: local
+--
+-- Timestamps, deletion log and triggers tracking the changes to public.forex
+-- for syncforex's cdc mode. Only on the local (forex3) database, which is the
+-- source of changes; migrate skips it elsewhere (see MAE_DB_ROLE).
+
+-- Existing rows get the time of the migration; the first cdc run replicates them all.
+ALTER TABLE public.forex
+    ADD COLUMN IF NOT EXISTS created_at timestamptz NOT NULL DEFAULT now(),
+    ADD COLUMN IF NOT EXISTS updated_at timestamptz NOT NULL DEFAULT now();
+
+CREATE INDEX IF NOT EXISTS forex_updated_at_idx
+    ON public.forex (updated_at);
+
+CREATE TABLE IF NOT EXISTS public.forex_deletions (
+    id          bigserial   PRIMARY KEY,
+    date        date        NOT NULL,
+    rueda       text,
+    instrumento text,
+    deleted_at  timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS forex_deletions_deleted_at_idx
+    ON public.forex_deletions (deleted_at);
+
+-- Bump updated_at on every update. A change of the natural key is logged as
+-- a deletion of the old key, so the old row is removed downstream.
+CREATE OR REPLACE FUNCTION public.forex_track_update() RETURNS trigger AS $$
+BEGIN
+    NEW.updated_at := now();
+    IF (OLD.date, OLD.rueda, OLD.instrumento) IS DISTINCT FROM (NEW.date, NEW.rueda, NEW.instrumento) THEN
+        INSERT INTO public.forex_deletions (date, rueda, instrumento)
+        VALUES (OLD.date, OLD.rueda, OLD.instrumento);
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION public.forex_track_delete() RETURNS trigger AS $$
+BEGIN
+    INSERT INTO public.forex_deletions (date, rueda, instrumento)
+    VALUES (OLD.date, OLD.rueda, OLD.instrumento);
+    RETURN OLD;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS forex_track_update ON public.forex;
+CREATE TRIGGER forex_track_update
+    BEFORE UPDATE ON public.forex
+    FOR EACH ROW EXECUTE FUNCTION public.forex_track_update();
+
+DROP TRIGGER IF EXISTS forex_track_delete ON public.forex;
+CREATE TRIGGER forex_track_delete
+    AFTER DELETE ON public.forex
+    FOR EACH ROW EXECUTE FUNCTION public.forex_track_delete();
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/jmtruffa/maescraper/dbconfig"
+	"github.com/jmtruffa/maescraper/runlog"
+)
+
+// status prints the configuration in use, the spooled files, the pending
+// migrations and the latest run of every command. It exits with the
+// database_error code when the database cannot be read.
+func status(ctx context.Context) {
+	profile, path := os.Getenv("MAE_PROFILE"), os.Getenv("MAE_CONFIG")
+	if path == "" {
+		path = "none"
+	}
+	if profile == "" {
+		profile = "none"
+	}
+	fmt.Printf("Configuration: %s (profile %s)\n", path, profile)
+	fmt.Printf("Version: %s\n", runlog.BuildVersion())
+
+	cfg := dbconfig.FromEnv("POSTGRES_")
+	if cc, err := cfg.ConnConfig(); err == nil {
+		fmt.Printf("Database: %s@%s:%d/%s\n", cc.User, cc.Host, cc.Port, cc.Database)
+	}
+
+	dir := spoolDir()
+	files, err := spooledFiles(dir)
+	if err != nil {
+		fmt.Printf("Spool: %s (unreadable: %v)\n", dir, err)
+	} else {
+		fmt.Printf("Spool: %s (%d files pending)\n", dir, len(files))
+	}
+
+	conn, err := dbconfig.Connect(ctx, cfg)
+	if err != nil {
+		fmt.Printf("Database unavailable: %v\n", err)
+		os.Exit(runlog.StatusDatabase.ExitCode())
+	}
+	defer conn.Close(ctx)
+
+	pending, err := pendingMigrations(ctx, conn)
+	if err != nil {
+		fmt.Printf("Migrations: unknown (%v)\n", err)
+	} else {
+		fmt.Printf("Migrations: %d pending\n", len(pending))
+		for _, m := range pending {
+			fmt.Printf("  %s\n", m.Name)
+		}
+	}
+
+	runs, err := runlog.Latest(ctx, conn)
+	if err != nil {
+		fmt.Printf("Runs: unknown (%v)\n", err)
+		conn.Close(ctx)
+		os.Exit(runlog.StatusDatabase.ExitCode())
+	}
+	fmt.Println()
+	runlog.Print(os.Stdout, runs)
+}
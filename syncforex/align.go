@@ -0,0 +1,216 @@
+package syncforex
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jmtruffa/maescraper/dbconfig"
+)
+
+// index is a plain (non-expression, non-partial) index or primary key.
+type index struct {
+	Name    string
+	Unique  bool
+	Columns []string
+}
+
+// schemaDiff is what a destination table lacks compared with the local one.
+// Only additive changes are ever applied; the rest is reported.
+type schemaDiff struct {
+	MissingTable bool
+	AddColumns   []column // destination names, local types
+	AddIndexes   []index  // destination column names
+	TypeChanged  []string // "column: local type vs destination type"
+	Extra        []string // destination columns that are not synced
+}
+
+func (d schemaDiff) empty() bool {
+	return !d.MissingTable && len(d.AddColumns) == 0 && len(d.AddIndexes) == 0 &&
+		len(d.TypeChanged) == 0 && len(d.Extra) == 0
+}
+
+// readIndexes returns the plain indexes of a table. Expression and partial
+// indexes cannot be compared by columns and are left out.
+func readIndexes(ctx context.Context, conn *pgx.Conn, table string) ([]index, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT i.relname, x.indisunique, array_agg(a.attname::text ORDER BY k.ord)
+		FROM pg_index x
+		JOIN pg_class i ON i.oid = x.indexrelid
+		CROSS JOIN LATERAL unnest(x.indkey::int2[]) WITH ORDINALITY k(attnum, ord)
+		JOIN pg_attribute a ON a.attrelid = x.indrelid AND a.attnum = k.attnum
+		WHERE x.indrelid = $1::text::regclass AND x.indexprs IS NULL AND x.indpred IS NULL
+		GROUP BY i.relname, x.indisunique
+		ORDER BY i.relname`, table)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[index])
+}
+
+// setIndexes keeps the indexes whose columns are all copied.
+func (s *tableSpec) setIndexes(all []index) {
+	s.indexes = nil
+	for _, idx := range all {
+		copied := true
+		for _, c := range idx.Columns {
+			if _, ok := s.column(c); !ok {
+				copied = false
+			}
+		}
+		if copied {
+			s.indexes = append(s.indexes, idx)
+		}
+	}
+}
+
+// diffSchema compares the local definition with the destination columns and
+// indexes; destCols is nil when the destination table does not exist.
+func diffSchema(t *tableSync, destCols []column, destIndexes []index) schemaDiff {
+	var diff schemaDiff
+	if destCols == nil {
+		diff.MissingTable = true
+	}
+
+	destTypes := map[string]string{}
+	for _, c := range destCols {
+		destTypes[c.Name] = c.Type
+	}
+	synced := map[string]bool{}
+	for _, c := range t.columns {
+		name := t.col(c.Name)
+		synced[name] = true
+		destType, ok := destTypes[name]
+		switch {
+		case !ok:
+			diff.AddColumns = append(diff.AddColumns, column{Name: name, Type: c.Type})
+		case destType != c.Type:
+			diff.TypeChanged = append(diff.TypeChanged, fmt.Sprintf("%s: %s vs %s", name, c.Type, destType))
+		}
+	}
+	for _, c := range destCols {
+		if !synced[c.Name] {
+			diff.Extra = append(diff.Extra, c.Name)
+		}
+	}
+
+	for _, idx := range t.indexes {
+		want := index{Name: idx.Name, Unique: idx.Unique, Columns: make([]string, len(idx.Columns))}
+		for i, c := range idx.Columns {
+			want.Columns[i] = t.col(c)
+		}
+		found := slices.ContainsFunc(destIndexes, func(have index) bool {
+			return have.Unique == want.Unique && slices.Equal(have.Columns, want.Columns)
+		})
+		if !found {
+			diff.AddIndexes = append(diff.AddIndexes, want)
+		}
+	}
+	return diff
+}
+
+// statements returns the DDL applying the additive part of the diff. New
+// columns are nullable, so existing destination rows stay valid.
+func (d schemaDiff) statements(table string) []string {
+	var stmts []string
+	if d.MissingTable {
+		defs := make([]string, len(d.AddColumns))
+		for i, c := range d.AddColumns {
+			defs[i] = quoteIdent(c.Name) + " " + c.Type
+		}
+		stmts = append(stmts, fmt.Sprintf("CREATE TABLE %s (%s)", quoteTable(table), strings.Join(defs, ", ")))
+	} else {
+		for _, c := range d.AddColumns {
+			stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s",
+				quoteTable(table), quoteIdent(c.Name), c.Type))
+		}
+	}
+	for _, idx := range d.AddIndexes {
+		unique := ""
+		if idx.Unique {
+			unique = "UNIQUE "
+		}
+		cols := make([]string, len(idx.Columns))
+		for i, c := range idx.Columns {
+			cols[i] = quoteIdent(c)
+		}
+		stmts = append(stmts, fmt.Sprintf("CREATE %sINDEX IF NOT EXISTS %s ON %s (%s)",
+			unique, quoteIdent(idx.Name), quoteTable(table), strings.Join(cols, ", ")))
+	}
+	return stmts
+}
+
+// alignSchema compares the destination table with the local one before it is
+// synced and reports the differences. With SYNC_ALIGN_SCHEMA=apply, missing
+// tables, columns and indexes are created in one transaction; otherwise a
+// destination lacking columns is an error, since every insert would fail.
+// Type changes and extra destination columns are only reported.
+func alignSchema(ctx context.Context, t *tableSync) error {
+	conn := t.dest.conn
+
+	var exists bool
+	if err := conn.QueryRow(ctx, "SELECT to_regclass($1::text) IS NOT NULL", t.target).Scan(&exists); err != nil {
+		return fmt.Errorf("look up destination table: %w", err)
+	}
+	var destCols []column
+	var destIndexes []index
+	if exists {
+		var err error
+		if destCols, err = readColumns(ctx, conn, t.target); err != nil {
+			return fmt.Errorf("read destination columns: %w", err)
+		}
+		if destIndexes, err = readIndexes(ctx, conn, t.target); err != nil {
+			return fmt.Errorf("read destination indexes: %w", err)
+		}
+	}
+
+	diff := diffSchema(t, destCols, destIndexes)
+	if diff.empty() {
+		return nil
+	}
+	if diff.MissingTable {
+		t.log().Warn("Destination table does not exist", "target", t.target)
+	} else {
+		for _, c := range diff.AddColumns {
+			t.log().Warn("Column is missing in the destination", "column", c.Name, "type", c.Type)
+		}
+	}
+	for _, idx := range diff.AddIndexes {
+		t.log().Warn("Index is missing in the destination", "index", idx.Name, "columns", idx.Columns)
+	}
+	for _, tc := range diff.TypeChanged {
+		t.log().Warn("Column type differs, local vs destination", "column", tc)
+	}
+	if len(diff.Extra) > 0 {
+		t.log().Info("Destination columns not synced", "columns", diff.Extra)
+	}
+
+	stmts := diff.statements(t.target)
+	if len(stmts) == 0 {
+		return nil
+	}
+	if envOrDefault("SYNC_ALIGN_SCHEMA", "") != "apply" {
+		if diff.MissingTable || len(diff.AddColumns) > 0 {
+			return fmt.Errorf("destination schema is behind (set SYNC_ALIGN_SCHEMA=apply to update it)")
+		}
+		return nil
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin schema change: %w", err)
+	}
+	defer dbconfig.Rollback(ctx, tx)
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(ctx, stmt); err != nil {
+			return fmt.Errorf("%s: %w", stmt, err)
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit schema change: %w", err)
+	}
+	t.log().Info("Applied schema changes", "changes", len(stmts), "target", t.target)
+	return nil
+}
@@ -0,0 +1,218 @@
+package syncforex
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jmtruffa/maescraper/dbconfig"
+	"github.com/jmtruffa/maescraper/metrics"
+)
+
+// defaultCDCOverlap is how far before the cursor each cdc run starts
+// reading, so rows from transactions that committed late are not missed.
+// Re-applying a change is harmless. Override with SYNC_CDC_OVERLAP.
+const defaultCDCOverlap = 5 * time.Minute
+
+// changeCursor is the position of the last replicated change, stored in
+// public.sync_cursor on each destination database.
+type changeCursor struct {
+	ChangedAt time.Time // latest forex.updated_at replicated
+	DeletedAt time.Time // latest forex_deletions.deleted_at replicated
+}
+
+// forexKey is the natural key of a deleted forex row (unique index forex_natural_key).
+type forexKey struct {
+	Date        time.Time
+	Rueda       *string
+	Instrumento *string
+}
+
+// syncChanges replicates inserts, updates and deletes made to the local forex
+// table since the stored cursor. Changes are read from a single snapshot and
+// applied in one destination transaction together with the new cursor:
+// deletions of rows no longer present locally first, then upserts, so a row
+// deleted and inserted again ends up present.
+func syncChanges(ctx context.Context, localConn *pgx.Conn, t *tableSync) (err error) {
+	defer func() {
+		if err != nil {
+			t.log().Error("Change replication failed", "error", err)
+		}
+	}()
+
+	cursor, err := readCursor(ctx, t.dest.conn, t.target)
+	if err != nil {
+		return fmt.Errorf("read change cursor: %w", err)
+	}
+	overlap := cdcOverlap()
+	changedSince, deletedSince := cursor.ChangedAt, cursor.DeletedAt
+	if !changedSince.IsZero() {
+		changedSince = changedSince.Add(-overlap)
+	}
+	if !deletedSince.IsZero() {
+		deletedSince = deletedSince.Add(-overlap)
+	}
+	t.log().Info("Replicating changes", "changed_since", formatCursor(cursor.ChangedAt),
+		"deleted_since", formatCursor(cursor.DeletedAt))
+
+	localTx, err := localConn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return fmt.Errorf("start local snapshot: %w", err)
+	}
+	defer dbconfig.Rollback(ctx, localTx)
+
+	deletions, lastDeleted, err := readDeletions(ctx, localTx, deletedSince)
+	if err != nil {
+		return fmt.Errorf("read local deletions: %w", err)
+	}
+
+	var lastChanged *time.Time
+	err = localTx.QueryRow(ctx, fmt.Sprintf("SELECT MAX(updated_at) FROM %s WHERE updated_at > $1", forexTable),
+		changedSince).Scan(&lastChanged)
+	if err != nil {
+		return fmt.Errorf("read local changes: %w", err)
+	}
+
+	rows, err := localTx.Query(ctx, fmt.Sprintf("SELECT %s FROM %s WHERE updated_at > $1 ORDER BY updated_at",
+		t.selectText(), forexTable), changedSince)
+	if err != nil {
+		return fmt.Errorf("read local changes: %w", err)
+	}
+	defer rows.Close()
+
+	start := time.Now()
+	cloudTx, err := t.dest.conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("start destination transaction: %w", err)
+	}
+	defer dbconfig.Rollback(ctx, cloudTx)
+
+	deleteQuery := fmt.Sprintf(`DELETE FROM %s
+		WHERE %s = $1 AND %s IS NOT DISTINCT FROM $2 AND %s IS NOT DISTINCT FROM $3`,
+		quoteTable(t.target), quoteIdent(t.col("date")), quoteIdent(t.col("rueda")), quoteIdent(t.col("instrumento")))
+	deleted := 0
+	for _, k := range deletions {
+		tag, err := cloudTx.Exec(ctx, deleteQuery, k.Date, k.Rueda, k.Instrumento)
+		if err != nil {
+			return fmt.Errorf("apply deletion (date=%s, instrumento=%s): %w", k.Date.Format("2006-01-02"), deref(k.Instrumento), err)
+		}
+		deleted += int(tag.RowsAffected())
+	}
+
+	upsert := t.upsert()
+	upserted := 0
+	for rows.Next() {
+		values, err := scanText(rows, len(t.columns))
+		if err != nil {
+			return fmt.Errorf("scan local row: %w", err)
+		}
+		if _, err := cloudTx.Exec(ctx, upsert, values...); err != nil {
+			return fmt.Errorf("upsert row %d: %w", upserted+1, err)
+		}
+		upserted++
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("read local changes: %w", err)
+	}
+
+	// The cursor never moves backwards
+	next := cursor
+	if lastChanged != nil && lastChanged.After(next.ChangedAt) {
+		next.ChangedAt = *lastChanged
+	}
+	if lastDeleted.After(next.DeletedAt) {
+		next.DeletedAt = lastDeleted
+	}
+	if err := writeCursor(ctx, cloudTx, t.target, next); err != nil {
+		return fmt.Errorf("store change cursor: %w", err)
+	}
+	if err := cloudTx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit changes: %w", err)
+	}
+	metrics.ObserveDBWrite("syncforex", "cdc", start)
+
+	t.log().Info("Replicated changes", "upserted", upserted, "deletions", len(deletions), "deleted", deleted)
+	t.dest.run.Add(0, upserted, 0, 0)
+	t.dest.run.Completed("%s: %s, %d filas replicadas y %d borradas", t.dest.Name, t.Name, upserted, deleted)
+	t.log().Info("Change cursor moved", "cursor", formatCursor(next.ChangedAt))
+	return nil
+}
+
+// readDeletions returns the deletions logged after the given time, in log
+// order, and the latest deleted_at among them. Keys present again in the
+// snapshot are left out: the row was reinserted and replaying its deletion,
+// as every run does within the overlap, would remove it downstream for good
+// once the change cursor has moved past the reinsert.
+func readDeletions(ctx context.Context, tx pgx.Tx, since time.Time) ([]forexKey, time.Time, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT d.date, d.rueda, d.instrumento, d.deleted_at, EXISTS (
+			SELECT 1 FROM public.forex f
+			WHERE f.date = d.date AND f.rueda IS NOT DISTINCT FROM d.rueda
+			  AND f.instrumento IS NOT DISTINCT FROM d.instrumento
+		)
+		FROM public.forex_deletions d
+		WHERE d.deleted_at > $1
+		ORDER BY d.id`, since)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer rows.Close()
+
+	var keys []forexKey
+	var last time.Time
+	for rows.Next() {
+		var k forexKey
+		var deletedAt time.Time
+		var present bool
+		if err := rows.Scan(&k.Date, &k.Rueda, &k.Instrumento, &deletedAt, &present); err != nil {
+			return nil, time.Time{}, err
+		}
+		if !present {
+			keys = append(keys, k)
+		}
+		if deletedAt.After(last) {
+			last = deletedAt
+		}
+	}
+	return keys, last, rows.Err()
+}
+
+func readCursor(ctx context.Context, conn *pgx.Conn, table string) (changeCursor, error) {
+	var c changeCursor
+	err := conn.QueryRow(ctx, "SELECT changed_at, deleted_at FROM public.sync_cursor WHERE table_name = $1", table).
+		Scan(&c.ChangedAt, &c.DeletedAt)
+	if err == pgx.ErrNoRows {
+		return changeCursor{}, nil
+	}
+	return c, err
+}
+
+func writeCursor(ctx context.Context, db execer, table string, c changeCursor) error {
+	_, err := db.Exec(ctx, `
+		INSERT INTO public.sync_cursor (table_name, changed_at, deleted_at, synced_at)
+		VALUES ($1, $2, $3, now())
+		ON CONFLICT (table_name) DO UPDATE
+		SET changed_at = EXCLUDED.changed_at, deleted_at = EXCLUDED.deleted_at, synced_at = EXCLUDED.synced_at`,
+		table, c.ChangedAt, c.DeletedAt)
+	return err
+}
+
+func cdcOverlap() time.Duration {
+	if v := envOrDefault("SYNC_CDC_OVERLAP", ""); v != "" {
+		d, err := time.ParseDuration(v)
+		if err == nil && d >= 0 {
+			return d
+		}
+		slog.Warn("Invalid SYNC_CDC_OVERLAP, using the default", "value", v, "default", defaultCDCOverlap)
+	}
+	return defaultCDCOverlap
+}
+
+func formatCursor(t time.Time) string {
+	if t.IsZero() {
+		return "the beginning"
+	}
+	return t.Format("2006-01-02 15:04:05.000000 -07:00")
+}
@@ -0,0 +1,99 @@
+package syncforex
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jmtruffa/maescraper/dbconfig"
+	"github.com/jmtruffa/maescraper/runlog"
+)
+
+// destination is a database the local tables are synced to. Each
+// destination keeps its own sync state, so one that is unreachable does not
+// hold back the others.
+type destination struct {
+	Name string `json:"name"`
+	dbconfig.Config
+	PasswordEnv string                  `json:"passwordEnv"` // secret holding the password, see secrets.Get
+	Tables      map[string]tableMapping `json:"tables"`      // by local table, for tables stored differently
+
+	conn    *pgx.Conn
+	run     *runlog.Run // statistics of this run, shared by all destinations
+	skipped bool        // another run held the destination's lock
+}
+
+// tableMapping names a local table and its columns on a destination.
+type tableMapping struct {
+	Table   string            `json:"table"`   // defaults to the local name
+	Columns map[string]string `json:"columns"` // local column -> destination column, for renamed columns
+}
+
+// loadDestinations reads the destinations from the JSON file named by
+// SYNC_DESTINATIONS_FILE, e.g.
+//
+//	[
+//	  {"name": "gcloud", "host": "10.0.0.5", "port": "15432", "user": "sync",
+//	   "passwordEnv": "GCLOUD_POSTGRES_PASSWORD", "database": "forex",
+//	   "sslmode": "verify-full", "sslrootcert": "/etc/syncforex/server-ca.pem",
+//	   "sslcert": "/etc/syncforex/client.pem", "sslkey": "/etc/syncforex/client.key",
+//	   "statementTimeout": "10m"},
+//	  {"name": "replica", "host": "replica.internal", "user": "sync",
+//	   "passwordEnv": "REPLICA_PASSWORD", "database": "marketdata",
+//	   "tables": {"public.forex": {"table": "mae.forex", "columns": {"monto": "volumen"}}}}
+//	]
+//
+// Connection fields are those of dbconfig.Config; "dsn" takes a full
+// connection string instead. Without the file, the single "gcloud"
+// destination is configured from the GCLOUD_POSTGRES_* variables (see
+// dbconfig.FromEnv).
+func loadDestinations() ([]*destination, error) {
+	path := os.Getenv("SYNC_DESTINATIONS_FILE")
+	if path == "" {
+		cfg := dbconfig.FromEnv("GCLOUD_POSTGRES_")
+		if cfg.DSN == "" && cfg.Port == "" {
+			cfg.Port = "15432"
+		}
+		return []*destination{{Name: "gcloud", Config: cfg}}, nil
+	}
+
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var dests []*destination
+	if err := json.Unmarshal(body, &dests); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if len(dests) == 0 {
+		return nil, fmt.Errorf("%s lists no destinations", path)
+	}
+
+	seen := map[string]bool{}
+	for i, d := range dests {
+		if d.Name == "" {
+			return nil, fmt.Errorf("destination %d has no name", i+1)
+		}
+		if seen[d.Name] {
+			return nil, fmt.Errorf("duplicate destination name '%s'", d.Name)
+		}
+		seen[d.Name] = true
+
+		d.Config = d.Config.WithPassword(d.PasswordEnv)
+	}
+	return dests, nil
+}
+
+// connect opens a new connection to the destination.
+func (d *destination) connect(ctx context.Context) (*pgx.Conn, error) {
+	return dbconfig.Connect(ctx, d.Config)
+}
+
+// log returns the logger for this destination's records, which carry its
+// name since destinations are synced in parallel.
+func (d *destination) log() *slog.Logger {
+	return slog.With("destination", d.Name)
+}
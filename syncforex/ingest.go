@@ -0,0 +1,353 @@
+package syncforex
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jmtruffa/maescraper/dbconfig"
+	"github.com/jmtruffa/maescraper/metrics"
+	"github.com/jmtruffa/maescraper/secrets"
+)
+
+const (
+	defaultIngestAddr     = ":8090"
+	defaultIngestMaxBytes = 64 << 20
+
+	// cursorHeader carries the change time of the newest row in a pushed batch
+	cursorHeader = "X-Sync-Cursor"
+
+	// ingestCommand labels the metrics of the ingest server
+	ingestCommand = "syncforex serve"
+
+	// ingestShutdownTimeout is how long the batches in flight have to be
+	// stored when the server stops
+	ingestShutdownTimeout = 30 * time.Second
+)
+
+// ingestServer receives rows pushed by syncforex push and upserts them into
+// its own database, for destinations that cannot be reached directly.
+// Batches are applied one at a time over a single connection, opened again
+// with connect once it is lost.
+type ingestServer struct {
+	token    string
+	maxBytes int64
+	tables   map[string]*tableSpec
+	connect  func(context.Context) (*pgx.Conn, error)
+
+	mu   sync.Mutex
+	conn *pgx.Conn
+}
+
+// serve runs the ingest server (mode serve) on SYNC_INGEST_ADDR, writing into
+// the POSTGRES_* database. Every request needs the header
+// "Authorization: Bearer $SYNC_INGEST_TOKEN". With SYNC_INGEST_TLS_CERT and
+// SYNC_INGEST_TLS_KEY it serves HTTPS.
+//
+//	POST /ingest/{table}         rows as a JSON array of objects, or one
+//	                             object per line with Content-Type
+//	                             application/x-ndjson; gzip with
+//	                             Content-Encoding: gzip. Values are the text
+//	                             form of each column, or null.
+//	GET  /ingest/{table}/cursor  {"changedAt": ...} of the last pushed batch
+//	GET  /metrics                Prometheus metrics, without authentication
+//
+// When ctx is cancelled it stops accepting requests and returns once the
+// batches in flight are stored.
+func serve(ctx context.Context, conn *pgx.Conn, tables []*tableSpec) error {
+	token, err := secrets.Get("SYNC_INGEST_TOKEN")
+	if err != nil {
+		return err
+	}
+	s := &ingestServer{
+		token:    token,
+		maxBytes: defaultIngestMaxBytes,
+		tables:   map[string]*tableSpec{},
+		connect:  connectLocal,
+		conn:     conn,
+	}
+	if s.token == "" {
+		return errors.New("SYNC_INGEST_TOKEN is not set")
+	}
+	if v := envOrDefault("SYNC_INGEST_MAX_BYTES", ""); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid SYNC_INGEST_MAX_BYTES '%s'", v)
+		}
+		s.maxBytes = n
+	}
+	for _, t := range tables {
+		s.tables[t.Name] = t
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /ingest/{table}", s.handleIngest)
+	mux.HandleFunc("GET /ingest/{table}/cursor", s.handleCursor)
+	mux.Handle("GET /metrics", metrics.Handler())
+	srv := &http.Server{
+		Addr:              envOrDefault("SYNC_INGEST_ADDR", defaultIngestAddr),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	cert, key := envOrDefault("SYNC_INGEST_TLS_CERT", ""), envOrDefault("SYNC_INGEST_TLS_KEY", "")
+	slog.Info("Ingest server listening", "addr", srv.Addr, "tables", len(s.tables))
+	errc := make(chan error, 1)
+	go func() {
+		if cert != "" || key != "" {
+			errc <- srv.ListenAndServeTLS(cert, key)
+			return
+		}
+		errc <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Stopping ingest server")
+	shutdown, cancel := context.WithTimeout(context.WithoutCancel(ctx), ingestShutdownTimeout)
+	defer cancel()
+	err = srv.Shutdown(shutdown)
+
+	// The caller closes conn, not a connection opened after it was lost
+	s.mu.Lock()
+	if s.conn != nil && s.conn != conn {
+		s.conn.Close(context.Background())
+	}
+	s.mu.Unlock()
+	return err
+}
+
+// db returns the connection, reconnecting when the last one was lost, e.g.
+// to a database restart. Callers hold s.mu.
+func (s *ingestServer) db(ctx context.Context) (*pgx.Conn, error) {
+	if s.conn != nil && !s.conn.IsClosed() {
+		return s.conn, nil
+	}
+	slog.Warn("Database connection lost, reconnecting")
+	conn, err := s.connect(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reconnect: %w", err)
+	}
+	s.conn = conn
+	return conn, nil
+}
+
+func (s *ingestServer) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+func (s *ingestServer) handleIngest(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	spec, ok := s.tables[r.PathValue("table")]
+	if !ok {
+		http.Error(w, "unknown table", http.StatusNotFound)
+		return
+	}
+
+	var cursor time.Time
+	if v := r.Header.Get(cursorHeader); v != "" {
+		var err error
+		if cursor, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			http.Error(w, "invalid "+cursorHeader, http.StatusBadRequest)
+			return
+		}
+	}
+
+	rows, err := decodeRows(http.MaxBytesReader(w, r.Body, s.maxBytes), r.Header, s.maxBytes)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "batch too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "invalid rows: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	for i, row := range rows {
+		for name := range row {
+			if _, ok := spec.column(name); !ok {
+				http.Error(w, fmt.Sprintf("row %d: unknown column '%s'", i+1, name), http.StatusBadRequest)
+				return
+			}
+		}
+		for _, k := range spec.Key {
+			if row[k] == nil {
+				http.Error(w, fmt.Sprintf("row %d: missing key column '%s'", i+1, k), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	start := time.Now()
+	n, err := s.upsertRows(r.Context(), spec, rows, cursor)
+	if err != nil {
+		slog.Error("Failed to ingest rows", "table", spec.Name, "rows", len(rows), "error", err)
+		metrics.AddRows(ingestCommand, "failed", len(rows))
+		http.Error(w, "failed to store rows", http.StatusInternalServerError)
+		return
+	}
+	metrics.ObserveDBWrite(ingestCommand, "ingest", start)
+	metrics.AddRows(ingestCommand, "inserted", n)
+	metrics.Succeeded(ingestCommand)
+	slog.Info("Ingested rows", "table", spec.Name, "rows", n)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"rows": n})
+}
+
+func (s *ingestServer) handleCursor(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	spec, ok := s.tables[r.PathValue("table")]
+	if !ok {
+		http.Error(w, "unknown table", http.StatusNotFound)
+		return
+	}
+
+	s.mu.Lock()
+	conn, err := s.db(r.Context())
+	var c changeCursor
+	if err == nil {
+		c, err = readCursor(r.Context(), conn, spec.Name)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		slog.Error("Failed to read cursor", "table", spec.Name, "error", err)
+		http.Error(w, "failed to read cursor", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pushCursor{ChangedAt: c.ChangedAt})
+}
+
+// pushCursor is the body of the cursor endpoint.
+type pushCursor struct {
+	ChangedAt time.Time `json:"changedAt"`
+}
+
+// decodeRows reads a batch of rows, each a map from column to text value.
+// A gzip body may not decompress to more than maxBytes either.
+func decodeRows(body io.Reader, h http.Header, maxBytes int64) ([]map[string]*string, error) {
+	if h.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		body = &limitReader{r: zr, left: maxBytes, limit: maxBytes}
+	}
+
+	dec := json.NewDecoder(body)
+	var rows []map[string]*string
+	if !strings.HasPrefix(h.Get("Content-Type"), "application/x-ndjson") {
+		err := dec.Decode(&rows)
+		return rows, err
+	}
+	for {
+		var row map[string]*string
+		err := dec.Decode(&row)
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", len(rows)+1, err)
+		}
+		rows = append(rows, row)
+	}
+}
+
+// limitReader fails with an *http.MaxBytesError once more than limit bytes
+// are read, like http.MaxBytesReader does for the request body.
+type limitReader struct {
+	r     io.Reader
+	left  int64
+	limit int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.left+1 {
+		p = p[:l.left+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) > l.left {
+		n, l.left = int(l.left), 0
+		return n, &http.MaxBytesError{Limit: l.limit}
+	}
+	l.left -= int64(n)
+	return n, err
+}
+
+// upsertRows writes the rows and, when given, the batch cursor in one
+// transaction. Each row writes only the columns it has, so a missing column
+// keeps its default on insert and its stored value on update; a column sent
+// as null is written as NULL.
+func (s *ingestServer) upsertRows(ctx context.Context, spec *tableSpec, rows []map[string]*string, cursor time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conn, err := s.db(ctx)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer dbconfig.Rollback(ctx, tx)
+
+	// One query per set of columns, in table order
+	queries := map[string]string{}
+	for i, row := range rows {
+		var cols []column
+		var names []string
+		var values []any
+		for _, c := range spec.columns {
+			if v, ok := row[c.Name]; ok {
+				cols = append(cols, c)
+				names = append(names, c.Name)
+				values = append(values, v)
+			}
+		}
+		set := strings.Join(names, ",")
+		upsert, ok := queries[set]
+		if !ok {
+			upsert = insertQuery(spec.Name, cols, spec.Key)
+			queries[set] = upsert
+		}
+		if _, err := tx.Exec(ctx, upsert, values...); err != nil {
+			return 0, fmt.Errorf("row %d: %w", i+1, err)
+		}
+	}
+	if !cursor.IsZero() {
+		// The cursor only moves forward; deleted_at belongs to the cdc mode
+		_, err := tx.Exec(ctx, `
+			INSERT INTO public.sync_cursor (table_name, changed_at, deleted_at, synced_at)
+			VALUES ($1, $2, $3, now())
+			ON CONFLICT (table_name) DO UPDATE
+			SET changed_at = GREATEST(sync_cursor.changed_at, EXCLUDED.changed_at), synced_at = EXCLUDED.synced_at`,
+			spec.Name, cursor, time.Time{})
+		if err != nil {
+			return 0, fmt.Errorf("store cursor: %w", err)
+		}
+	}
+	return len(rows), tx.Commit(ctx)
+}
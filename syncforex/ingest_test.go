@@ -0,0 +1,136 @@
+package syncforex
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestIngestRejects(t *testing.T) {
+	spec := &tableSpec{Name: forexTable, Key: []string{"date", "instrumento"}, Incremental: "date"}
+	if err := spec.setColumns([]column{{"date", "date"}, {"instrumento", "text"}}); err != nil {
+		t.Fatal(err)
+	}
+	s := &ingestServer{token: "secret", maxBytes: 64, tables: map[string]*tableSpec{forexTable: spec}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /ingest/{table}", s.handleIngest)
+
+	tests := []struct {
+		name, table, token, body string
+		want                     int
+	}{
+		{"no token", forexTable, "", `[]`, http.StatusUnauthorized},
+		{"wrong token", forexTable, "nope", `[]`, http.StatusUnauthorized},
+		{"unknown table", "public.other", "secret", `[]`, http.StatusNotFound},
+		{"unknown column", forexTable, "secret", `[{"date": "2024-11-15", "monto": "1"}]`, http.StatusBadRequest},
+		{"not text", forexTable, "secret", `[{"date": 20241115}]`, http.StatusBadRequest},
+		{"missing key", forexTable, "secret", `[{"date": "2024-11-15"}]`, http.StatusBadRequest},
+		{"null key", forexTable, "secret", `[{"date": "2024-11-15", "instrumento": null}]`, http.StatusBadRequest},
+		{"too large", forexTable, "secret", `[` + strings.Repeat(`{"instrumento": "USD"},`, 10) + `]`, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/ingest/"+tt.table, strings.NewReader(tt.body))
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d (%s)", tt.name, rec.Code, tt.want, strings.TrimSpace(rec.Body.String()))
+		}
+	}
+
+	// A gzip body within the limit may not decompress past it
+	s.maxBytes = 1000
+	var bomb bytes.Buffer
+	zw := gzip.NewWriter(&bomb)
+	zw.Write([]byte(`[{"date": "2024-11-15", "instrumento": "` + strings.Repeat("A", 10000) + `"}]`))
+	zw.Close()
+	if bomb.Len() >= 1000 {
+		t.Fatalf("compressed body is %d bytes, want less than the limit", bomb.Len())
+	}
+	req := httptest.NewRequest(http.MethodPost, "/ingest/"+forexTable, &bomb)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Content-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("gzip bomb: status %d, want %d (%s)", rec.Code, http.StatusRequestEntityTooLarge, strings.TrimSpace(rec.Body.String()))
+	}
+}
+
+// Without a database connection every batch tries to open a new one, so the
+// server recovers once the database is back.
+func TestIngestReconnects(t *testing.T) {
+	spec := &tableSpec{Name: forexTable, Key: []string{"date"}, Incremental: "date"}
+	if err := spec.setColumns([]column{{"date", "date"}}); err != nil {
+		t.Fatal(err)
+	}
+	attempts := 0
+	s := &ingestServer{token: "secret", maxBytes: 64, tables: map[string]*tableSpec{forexTable: spec},
+		connect: func(context.Context) (*pgx.Conn, error) {
+			attempts++
+			return nil, errors.New("connection refused")
+		}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /ingest/{table}", s.handleIngest)
+
+	for range 2 {
+		req := httptest.NewRequest(http.MethodPost, "/ingest/"+forexTable, strings.NewReader(`[{"date": "2024-11-15"}]`))
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusInternalServerError {
+			t.Errorf("status %d, want %d", rec.Code, http.StatusInternalServerError)
+		}
+	}
+	if attempts != 2 {
+		t.Errorf("%d connection attempts, want one per batch", attempts)
+	}
+}
+
+func TestPushBatchEncoding(t *testing.T) {
+	usd, price := "USD", "1045.5"
+	sent := []map[string]*string{
+		{"date": ptr("2024-11-15"), "instrumento": &usd, "cotizacion": &price},
+		{"date": ptr("2024-11-15"), "instrumento": ptr("EUR"), "cotizacion": nil},
+	}
+	cursor := time.Date(2024, 11, 15, 18, 30, 0, 123456000, time.UTC)
+
+	var got []map[string]*string
+	var gotCursor string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" || r.URL.Path != "/ingest/public.forex" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		var err error
+		if got, err = decodeRows(r.Body, r.Header, defaultIngestMaxBytes); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		gotCursor = r.Header.Get(cursorHeader)
+	}))
+	defer srv.Close()
+
+	c := &pushClient{baseURL: srv.URL, token: "secret", http: srv.Client()}
+	if err := c.send(t.Context(), forexTable, sent, cursor); err != nil {
+		t.Fatalf("send() error: %v", err)
+	}
+	if len(got) != 2 || *got[0]["cotizacion"] != "1045.5" || got[1]["cotizacion"] != nil || *got[1]["instrumento"] != "EUR" {
+		t.Errorf("server decoded %v", got)
+	}
+	if gotCursor != "2024-11-15T18:30:00.123456Z" {
+		t.Errorf("cursor header = %s", gotCursor)
+	}
+}
+
+func ptr(s string) *string { return &s }
@@ -0,0 +1,81 @@
+package syncforex
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// lagThreshold is SYNC_LAG_ALERT_DAYS, the number of days the newest date in
+// a destination table may trail the newest local one before an alert is
+// raised (see alert.Notify); 0, the default, disables the check.
+func lagThreshold() int {
+	v := os.Getenv("SYNC_LAG_ALERT_DAYS")
+	if v == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		slog.Warn("Invalid SYNC_LAG_ALERT_DAYS, lag check disabled", "value", v)
+		return 0
+	}
+	return n
+}
+
+// checkLag raises an alert on the run when the destination table is more
+// than threshold days behind the local one.
+func checkLag(ctx context.Context, localConn *pgx.Conn, t *tableSync, threshold int) error {
+	local, err := newestDate(ctx, localConn, fmt.Sprintf("SELECT MAX(%s) FROM %s", t.localPartition(), quoteTable(t.Name)))
+	if err != nil {
+		return fmt.Errorf("newest local date: %w", err)
+	}
+	dest, err := newestDate(ctx, t.dest.conn, fmt.Sprintf("SELECT MAX(%s) FROM %s", t.targetPartition(), quoteTable(t.target)))
+	if err != nil {
+		return fmt.Errorf("newest destination date: %w", err)
+	}
+	days, ok := lagDays(local, dest)
+	if ok && days <= threshold {
+		return nil
+	}
+
+	title := fmt.Sprintf("%s in %s is %d days behind", t.Name, t.dest.Name, days)
+	if !ok {
+		title = fmt.Sprintf("%s in %s has no rows", t.Name, t.dest.Name)
+	}
+	t.log().Warn("Destination is behind", "days", days, "local", formatDate(local), "destination", formatDate(dest))
+	t.dest.run.Alert("lag:"+t.dest.Name+":"+t.Name, title,
+		fmt.Sprintf("Newest local date %s, newest in the destination %s (threshold %d days)",
+			formatDate(local), formatDate(dest), threshold))
+	return nil
+}
+
+// newestDate runs a MAX query, nil when the table is empty.
+func newestDate(ctx context.Context, conn *pgx.Conn, query string) (*time.Time, error) {
+	var d *time.Time
+	err := conn.QueryRow(ctx, query).Scan(&d)
+	return d, err
+}
+
+// lagDays is how many days dest trails local, 0 when local is empty. It is
+// not ok when dest is empty but local is not.
+func lagDays(local, dest *time.Time) (int, bool) {
+	switch {
+	case local == nil:
+		return 0, true
+	case dest == nil:
+		return 0, false
+	}
+	return max(int(local.Sub(*dest).Hours()/24), 0), true
+}
+
+func formatDate(d *time.Time) string {
+	if d == nil {
+		return "none"
+	}
+	return d.Format("2006-01-02")
+}
@@ -0,0 +1,218 @@
+package syncforex
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jmtruffa/maescraper/lock"
+	"github.com/jmtruffa/maescraper/runlog"
+	"github.com/jmtruffa/maescraper/secrets"
+)
+
+// defaultPushBatch is how many rows each pushed request carries. Override
+// with SYNC_PUSH_BATCH.
+const defaultPushBatch = 5000
+
+// pushClient sends rows to an ingest server (see serve).
+type pushClient struct {
+	baseURL string
+	token   string
+	http    *http.Client
+	run     *runlog.Run
+}
+
+// push sends the rows of every table changed since the server's cursor to
+// the ingest server at SYNC_PUSH_URL (mode push), for destinations that
+// cannot be reached directly. Rows are read in order of the table's changed
+// column and sent in gzip'd NDJSON batches, each carrying its newest change
+// time, so an interrupted push resumes after the last stored batch.
+func push(ctx context.Context, localConn *pgx.Conn, tables []*tableSpec, run *runlog.Run) error {
+	token, err := secrets.Get("SYNC_INGEST_TOKEN")
+	if err != nil {
+		return err
+	}
+	c := &pushClient{
+		baseURL: strings.TrimSuffix(envOrDefault("SYNC_PUSH_URL", ""), "/"),
+		token:   token,
+		http:    &http.Client{Timeout: 5 * time.Minute},
+		run:     run,
+	}
+	if c.baseURL == "" || c.token == "" {
+		return fmt.Errorf("SYNC_PUSH_URL and SYNC_INGEST_TOKEN must be set")
+	}
+
+	// Two pushes would send the same batches
+	l, err := lock.Acquire(ctx, localConn, lock.SyncPush, run)
+	if lock.Held(err) {
+		slog.Warn("Skipping run", "error", err)
+		run.Skip(err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer l.Release(context.Background())
+
+	var failed []string
+	for _, t := range tables {
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		if err := c.pushTable(ctx, localConn, t); err != nil {
+			slog.Error("Failed to push", "table", t.Name, "error", err)
+			failed = append(failed, t.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("push failed for %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func (c *pushClient) pushTable(ctx context.Context, localConn *pgx.Conn, t *tableSpec) error {
+	cursor, err := c.cursor(ctx, t.Name)
+	if err != nil {
+		return fmt.Errorf("read cursor: %w", err)
+	}
+	since := cursor
+	if !since.IsZero() {
+		since = since.Add(-cdcOverlap())
+	}
+	slog.Info("Pushing changes", "table", t.Name, "changed_since", formatCursor(cursor))
+
+	changed := quoteIdent(t.changedColumn())
+	rows, err := localConn.Query(ctx, fmt.Sprintf("SELECT %s, %s FROM %s WHERE %s >= $1 ORDER BY %s",
+		t.selectText(), changed, quoteTable(t.Name), changed, changed), since)
+	if err != nil {
+		return fmt.Errorf("read local rows: %w", err)
+	}
+	defer rows.Close()
+
+	names := t.columnNames()
+	batchSize := pushBatch()
+	var batch []map[string]*string
+	var last time.Time
+	pushed := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := c.send(ctx, t.Name, batch, last); err != nil {
+			return err
+		}
+		pushed += len(batch)
+		c.run.Add(len(batch), len(batch), 0, 0)
+		batch = batch[:0]
+		return nil
+	}
+
+	for rows.Next() {
+		values := make([]*string, len(names))
+		dest := make([]any, len(names)+1)
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		dest[len(names)] = &last
+		if err := rows.Scan(dest...); err != nil {
+			return fmt.Errorf("scan local row: %w", err)
+		}
+		row := make(map[string]*string, len(names))
+		for i, name := range names {
+			row[name] = values[i]
+		}
+		batch = append(batch, row)
+		if len(batch) == batchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("read local rows: %w", err)
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	slog.Info("Pushed rows", "table", t.Name, "rows", pushed)
+	c.run.Completed("%s: %d filas enviadas", t.Name, pushed)
+	return nil
+}
+
+func (c *pushClient) cursor(ctx context.Context, table string) (time.Time, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/ingest/"+url.PathEscape(table)+"/cursor", nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var body pushCursor
+	if err := c.do(req, &body); err != nil {
+		return time.Time{}, err
+	}
+	return body.ChangedAt, nil
+}
+
+// send posts one batch as gzip'd NDJSON.
+func (c *pushClient) send(ctx context.Context, table string, rows []map[string]*string, cursor time.Time) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	for _, row := range rows {
+		if err := enc.Encode(row); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/ingest/"+url.PathEscape(table), &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set(cursorHeader, cursor.Format(time.RFC3339Nano))
+	if err := c.do(req, nil); err != nil {
+		return fmt.Errorf("send %d rows: %w", len(rows), err)
+	}
+	return nil
+}
+
+func (c *pushClient) do(req *http.Request, out any) error {
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("ingest server returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func pushBatch() int {
+	if v := envOrDefault("SYNC_PUSH_BATCH", ""); v != "" {
+		n, err := strconv.Atoi(v)
+		if err == nil && n > 0 {
+			return n
+		}
+		slog.Warn("Invalid SYNC_PUSH_BATCH, using the default", "value", v, "default", defaultPushBatch)
+	}
+	return defaultPushBatch
+}
@@ -0,0 +1,122 @@
+package syncforex
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// pendingDate is a date whose rows must be (re)synced to a destination.
+type pendingDate struct {
+	Date       time.Time
+	LocalCount int64
+}
+
+// execer is implemented by both *pgx.Conn and pgx.Tx.
+type execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+// pendingDates compares the local row counts per date with the destination
+// row counts and the recorded sync state (public.sync_state). A date is
+// pending when it was never recorded as synced or when any of the counts
+// differ. Dates already complete in the destination but missing from the sync
+// state (e.g. synced before the state table existed) are recorded without copying.
+func pendingDates(ctx context.Context, localConn *pgx.Conn, t *tableSync) ([]pendingDate, error) {
+	localCounts, err := countsByDate(ctx, localConn, quoteTable(t.Name), t.localPartition())
+	if err != nil {
+		return nil, fmt.Errorf("count local rows: %w", err)
+	}
+	cloudCounts, err := countsByDate(ctx, t.dest.conn, quoteTable(t.target), t.targetPartition())
+	if err != nil {
+		return nil, fmt.Errorf("count destination rows: %w", err)
+	}
+	state, err := syncState(ctx, t.dest.conn, t.target)
+	if err != nil {
+		return nil, fmt.Errorf("read sync state: %w", err)
+	}
+
+	var pending []pendingDate
+	adopted := 0
+	for date, localCount := range localCounts {
+		cloudCount := cloudCounts[date]
+		recorded, ok := state[date]
+
+		switch {
+		case ok && recorded == localCount && cloudCount == localCount:
+			continue
+		case !ok && cloudCount == localCount:
+			if err := recordSyncedDate(ctx, t.dest.conn, t.target, date, int(localCount)); err != nil {
+				return nil, fmt.Errorf("record sync state: %w", err)
+			}
+			adopted++
+			continue
+		case ok:
+			t.log().Warn("Date changed since last sync", "date", date.Format("2006-01-02"),
+				"local", localCount, "destination_rows", cloudCount, "synced", recorded)
+		}
+		pending = append(pending, pendingDate{Date: date, LocalCount: localCount})
+	}
+	if adopted > 0 {
+		t.log().Info("Recorded dates already complete in the destination as synced", "dates", adopted)
+	}
+
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Date.Before(pending[j].Date) })
+	return pending, nil
+}
+
+// countsByDate returns the number of rows per date in the given table, with
+// dateExpr giving the date of a row.
+func countsByDate(ctx context.Context, conn *pgx.Conn, table, dateExpr string) (map[time.Time]int64, error) {
+	rows, err := conn.Query(ctx, fmt.Sprintf("SELECT %s, COUNT(*) FROM %s GROUP BY 1", dateExpr, table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[time.Time]int64)
+	for rows.Next() {
+		var date time.Time
+		var n int64
+		if err := rows.Scan(&date, &n); err != nil {
+			return nil, err
+		}
+		counts[date] = n
+	}
+	return counts, rows.Err()
+}
+
+// syncState returns the row count recorded for each synced date of a table.
+func syncState(ctx context.Context, conn *pgx.Conn, table string) (map[time.Time]int64, error) {
+	rows, err := conn.Query(ctx, "SELECT date, row_count FROM public.sync_state WHERE table_name = $1", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	state := make(map[time.Time]int64)
+	for rows.Next() {
+		var date time.Time
+		var n int64
+		if err := rows.Scan(&date, &n); err != nil {
+			return nil, err
+		}
+		state[date] = n
+	}
+	return state, rows.Err()
+}
+
+// recordSyncedDate stores the completed date and its row count.
+func recordSyncedDate(ctx context.Context, db execer, table string, date time.Time, rowCount int) error {
+	_, err := db.Exec(ctx, `
+		INSERT INTO public.sync_state (table_name, date, row_count, synced_at)
+		VALUES ($1, $2, $3, now())
+		ON CONFLICT (table_name, date) DO UPDATE
+		SET row_count = EXCLUDED.row_count, synced_at = EXCLUDED.synced_at`,
+		table, date, rowCount)
+	return err
+}
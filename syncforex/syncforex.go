@@ -0,0 +1,263 @@
+// Package syncforex copies the local public.forex and other tables to one or
+// more destination databases. It is the sync command of maescraper.
+package syncforex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jmtruffa/maescraper/dbconfig"
+	"github.com/jmtruffa/maescraper/lock"
+	"github.com/jmtruffa/maescraper/logging"
+	"github.com/jmtruffa/maescraper/runlog"
+)
+
+// forexTable is the table maescraper and historicoforex load, and the only
+// one with change tracking for the cdc mode.
+const forexTable = "public.forex"
+
+// Run runs one mode, "" being sync, then exits:
+//
+//	sync    copy new and incomplete dates to the cloud (default)
+//	verify  compare per-date row counts and checksums and list differing dates
+//	repair  verify, then replace the differing dates in the cloud with the local rows
+//	cdc     replicate inserts, updates and deletes since the stored change cursor
+//	push    send new and changed rows to an ingest server over HTTP (see push)
+//	serve   run the ingest server in front of the POSTGRES_* database (see serve)
+//
+// Every table (see loadTables) is synced to every destination (see
+// loadDestinations); destinations run in parallel. Each destination table is
+// first checked against the local one (see alignSchema). Every run is
+// recorded in public.ingest_runs of the local database. With
+// SYNC_LAG_ALERT_DAYS set, an alert is raised for every table whose
+// destination falls further behind (see checkLag and alert.Notify).
+//
+// When ctx is cancelled the table being synced is rolled back and left for the
+// next run, and the run ends as interrupted; serve shuts down gracefully.
+//
+// Logs go to stderr through log/slog (see logging.Setup); a summary of the
+// run is printed to stdout at the end. The exit code tells the outcome, see
+// runlog.Status.ExitCode.
+func Run(ctx context.Context, mode string) {
+	if mode == "" {
+		mode = "sync"
+	}
+	switch mode {
+	case "sync", "verify", "repair", "cdc", "push", "serve":
+	default:
+		log.Printf("Unknown mode '%s' (use sync, verify, repair, cdc, push or serve)", mode)
+		os.Exit(runlog.StatusValidation.ExitCode())
+	}
+
+	// Stopping is how the ingest server ends, not an interruption
+	runCtx := ctx
+	if mode == "serve" {
+		runCtx = context.Background()
+	}
+	run := runlog.Start(runCtx, "syncforex "+mode)
+	logging.Setup(run.Command, run.RunID)
+	slog.Info("Iniciando syncForex", "mode", mode, "version", run.Version)
+
+	tables, err := loadTables()
+	if err != nil {
+		run.Fatalf(runlog.StatusValidation, "Invalid sync tables: %v", err)
+	}
+	if mode == "serve" {
+		tables = withoutChanged(tables)
+	}
+
+	// Table columns are read once from the local catalog and shared by all destinations
+	localConn, err := connectLocal(ctx)
+	if err != nil {
+		run.Fatalf(runlog.StatusDatabase, "Unable to connect to local database: %v", err)
+	}
+	if err := describeTables(ctx, localConn, tables); err != nil {
+		run.Fatalf(runlog.StatusDatabase, "Unable to read local table definitions: %v", err)
+	}
+
+	// push and serve use the local connection only
+	if mode == "push" || mode == "serve" {
+		if mode == "push" {
+			err = push(ctx, localConn, tables, run)
+		} else {
+			err = serve(ctx, localConn, tables)
+		}
+		localConn.Close(context.Background())
+		if err != nil {
+			run.Fatalf(runlog.StatusFailed, "%s failed: %v", mode, err)
+		}
+		run.Exit()
+	}
+	localConn.Close(context.Background())
+
+	dests, err := loadDestinations()
+	if err != nil {
+		run.Fatalf(runlog.StatusValidation, "Invalid sync destinations: %v", err)
+	}
+
+	results := make([]error, len(dests))
+	var wg sync.WaitGroup
+	for i, d := range dests {
+		d.run = run
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = runDestination(ctx, d, tables, mode)
+		}()
+	}
+	wg.Wait()
+
+	for i, d := range dests {
+		if results[i] != nil {
+			run.Failf(runlog.StatusDatabase, "%s: %v", d.Name, results[i])
+		}
+	}
+	run.Finish()
+
+	// Per-destination outcome ahead of the summary
+	for i, d := range dests {
+		if results[i] != nil && ctx.Err() != nil {
+			fmt.Printf("Destination %s: INTERRUPTED (%v)\n", d.Name, results[i])
+		} else if results[i] != nil {
+			fmt.Printf("Destination %s: FAILED (%v)\n", d.Name, results[i])
+		} else if d.skipped {
+			fmt.Printf("Destination %s: SKIPPED (another run holds the lock)\n", d.Name)
+		} else {
+			fmt.Printf("Destination %s: OK\n", d.Name)
+		}
+	}
+	run.PrintSummary(os.Stdout)
+	os.Exit(run.Status.ExitCode())
+}
+
+// runDestination syncs every table to one destination using its own local
+// and destination connections, so destinations never wait on each other.
+func runDestination(ctx context.Context, d *destination, tables []*tableSpec, mode string) error {
+	localConn, err := connectLocal(ctx)
+	if err != nil {
+		d.log().Error("Unable to connect to local database", "error", err)
+		return err
+	}
+	defer localConn.Close(context.Background())
+
+	d.conn, err = d.connect(ctx)
+	if err != nil {
+		d.log().Error("Unable to connect to destination database", "error", err)
+		return err
+	}
+	defer d.conn.Close(context.Background())
+	d.log().Info("Connected to local and destination databases")
+
+	// One run per destination at a time, so two never copy the same dates
+	l, err := lock.Acquire(ctx, d.conn, lock.Sync, d.run)
+	if lock.Held(err) {
+		d.log().Warn("Skipping destination", "error", err)
+		d.run.Skip(fmt.Errorf("%s: %w", d.Name, err))
+		d.skipped = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer l.Release(context.Background())
+
+	// A failing table does not stop the others
+	var errs []error
+	lag := lagThreshold()
+	for _, spec := range tables {
+		if ctx.Err() != nil {
+			d.log().Warn("Interrupted, the remaining tables are left for the next run", "next_table", spec.Name)
+			errs = append(errs, context.Cause(ctx))
+			break
+		}
+		t := newTableSync(d, spec)
+		if mode == "cdc" && t.Name != forexTable {
+			t.log().Info("No change tracking, use sync for this table")
+			continue
+		}
+		if err := syncTable(ctx, localConn, t, mode); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", t.Name, err))
+		}
+		// Also after a failure, which is when the destination falls behind
+		if lag > 0 && ctx.Err() == nil && !d.conn.IsClosed() {
+			if err := checkLag(ctx, localConn, t, lag); err != nil {
+				t.log().Warn("Lag check failed", "error", err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// syncTable checks the destination table against the local one and runs the
+// mode on it.
+func syncTable(ctx context.Context, localConn *pgx.Conn, t *tableSync, mode string) error {
+	if err := alignSchema(ctx, t); err != nil {
+		t.log().Error("Schema check failed", "error", err)
+		return err
+	}
+	switch mode {
+	case "verify":
+		_, _, err := verify(ctx, localConn, t)
+		return err
+	case "repair":
+		return repair(ctx, localConn, t)
+	case "cdc":
+		return syncChanges(ctx, localConn, t)
+	default:
+		return syncPending(ctx, localConn, t)
+	}
+}
+
+// syncPending copies every date that is missing or incomplete in the destination.
+func syncPending(ctx context.Context, localConn *pgx.Conn, t *tableSync) error {
+	// Work out which dates are missing or incomplete in the destination
+	pending, err := pendingDates(ctx, localConn, t)
+	if err != nil {
+		t.log().Error("Failed to compare local and destination rows", "error", err)
+		return err
+	}
+	if len(pending) == 0 {
+		t.log().Info("Destination is up to date. Nothing to do.")
+		return nil
+	}
+	t.log().Info("Dates to sync", "dates", len(pending),
+		"from", pending[0].Date.Format("2006-01-02"), "to", pending[len(pending)-1].Date.Format("2006-01-02"))
+	t.dest.run.SetRange(pending[0].Date, pending[len(pending)-1].Date)
+
+	rows, err := transfer(ctx, t, pending)
+	if err != nil {
+		t.log().Error("Failed to sync dates, they will be retried on the next run", "dates", len(pending), "error", err)
+		return err
+	}
+	t.log().Info("Synced rows", "rows", rows, "dates", len(pending), "target", t.target)
+	t.dest.run.Add(0, int(rows), 0, 0)
+	t.dest.run.Completed("%s: %s, %d fechas (%d filas)", t.dest.Name, t.Name, len(pending), rows)
+	return nil
+}
+
+// connectLocal connects to the local PostgreSQL (source: forex3) - POSTGRES_*
+// or DATABASE_URL, see dbconfig.FromEnv
+func connectLocal(ctx context.Context) (*pgx.Conn, error) {
+	return dbconfig.Connect(ctx, dbconfig.FromEnv("POSTGRES_"))
+}
+
+func envOrDefault(key, defaultVal string) string {
+	val := os.Getenv(key)
+	if val == "" {
+		return defaultVal
+	}
+	return val
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
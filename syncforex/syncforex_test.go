@@ -0,0 +1,235 @@
+package syncforex
+
+import (
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func day(s string) time.Time {
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestMismatchedDates(t *testing.T) {
+	local := map[time.Time]dateChecksum{
+		day("2024-11-13"): {Count: 3, Hash: "aaa"},
+		day("2024-11-14"): {Count: 3, Hash: "bbb"},
+		day("2024-11-15"): {Count: 3, Hash: "ccc"},
+		day("2024-11-18"): {Count: 2, Hash: "ddd"},
+	}
+	cloud := map[time.Time]dateChecksum{
+		day("2024-11-12"): {Count: 1, Hash: "zzz"}, // deleted locally
+		day("2024-11-13"): {Count: 3, Hash: "aaa"}, // in sync
+		day("2024-11-14"): {Count: 3, Hash: "xxx"}, // row corrected locally
+		day("2024-11-15"): {Count: 2, Hash: "ccc"}, // row missing in cloud
+		// 2024-11-18 never synced
+	}
+
+	got := mismatchedDates(local, cloud)
+	want := []time.Time{day("2024-11-12"), day("2024-11-14"), day("2024-11-15"), day("2024-11-18")}
+	if !slices.Equal(got, want) {
+		t.Errorf("mismatchedDates() = %v, want %v", got, want)
+	}
+}
+
+func TestInsertQuery(t *testing.T) {
+	cols := []column{{"date", "date"}, {"rueda", "text"}, {"instrumento", "text"}, {"cotizacion", "numeric(18,4)"}, {"monto", "double precision"}}
+	got := insertQuery("public.forex", cols, []string{"date", "rueda", "instrumento"})
+	want := `INSERT INTO "public"."forex" ("date", "rueda", "instrumento", "cotizacion", "monto") ` +
+		`VALUES ($1::text::date, $2::text::text, $3::text::text, $4::text::numeric(18,4), $5::text::double precision) ` +
+		`ON CONFLICT ("date", "rueda", "instrumento") DO UPDATE SET "cotizacion" = EXCLUDED."cotizacion", "monto" = EXCLUDED."monto"`
+	if got != want {
+		t.Errorf("insertQuery() =\n%s\nwant\n%s", got, want)
+	}
+
+	got = insertQuery("runs", cols[:2], nil)
+	want = `INSERT INTO "runs" ("date", "rueda") VALUES ($1::text::date, $2::text::text)`
+	if got != want {
+		t.Errorf("insertQuery() without key =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestTableSync(t *testing.T) {
+	spec := &tableSpec{Name: "public.forex_instruments", Key: []string{"ticker", "codigo_segmento"},
+		Incremental: "updated_at", Exclude: []string{"active"}}
+	err := spec.setColumns([]column{
+		{"ticker", "text"}, {"codigo_segmento", "text"}, {"last_seen", "date"},
+		{"active", "boolean"}, {"updated_at", "timestamp with time zone"},
+	})
+	if err != nil {
+		t.Fatalf("setColumns() error: %v", err)
+	}
+	if got, want := spec.columnNames(), []string{"ticker", "codigo_segmento", "last_seen", "updated_at"}; !slices.Equal(got, want) {
+		t.Errorf("columns = %v, want %v", got, want)
+	}
+
+	d := &destination{Name: "replica", Tables: map[string]tableMapping{
+		"public.forex_instruments": {Table: "mae.instruments", Columns: map[string]string{"updated_at": "modified"}},
+	}}
+	ts := newTableSync(d, spec)
+	if ts.target != "mae.instruments" {
+		t.Errorf("target = %s, want mae.instruments", ts.target)
+	}
+	if got, want := ts.localPartition(), `("updated_at" AT TIME ZONE 'UTC')::date`; got != want {
+		t.Errorf("localPartition() = %s, want %s", got, want)
+	}
+	if got, want := ts.targetPartition(), `("modified" AT TIME ZONE 'UTC')::date`; got != want {
+		t.Errorf("targetPartition() = %s, want %s", got, want)
+	}
+
+	spec.Incremental = "ticker"
+	if err := spec.setColumns([]column{{"ticker", "text"}, {"codigo_segmento", "text"}}); err == nil {
+		t.Error("setColumns() accepted a text incremental column")
+	}
+	spec.Incremental, spec.Key = "last_seen", []string{"missing"}
+	if err := spec.setColumns([]column{{"ticker", "text"}, {"last_seen", "date"}}); err == nil {
+		t.Error("setColumns() accepted a missing key column")
+	}
+}
+
+// The ingest server's database has no updated_at, see sql/011.
+func TestServeTables(t *testing.T) {
+	cloud := []column{{"date", "date"}, {"rueda", "text"}, {"instrumento", "text"}, {"cotizacion", "numeric"}}
+	push := *defaultTables[0]
+	if err := push.setColumns(cloud); err == nil {
+		t.Error("setColumns() accepted a missing changed column")
+	}
+	spec := withoutChanged(defaultTables)[0]
+	if err := spec.setColumns(cloud); err != nil {
+		t.Errorf("setColumns() error for serve: %v", err)
+	}
+	if defaultTables[0].Changed != "updated_at" {
+		t.Error("withoutChanged() modified the default tables")
+	}
+}
+
+func TestLoadDestinations(t *testing.T) {
+	path := t.TempDir() + "/destinations.json"
+	body := `[
+		{"name": "gcloud", "host": "10.0.0.5", "user": "sync", "passwordEnv": "TEST_SYNC_PASSWORD", "database": "forex"},
+		{"name": "replica", "host": "replica", "port": "6432", "database": "marketdata",
+		 "tables": {"public.forex": {"table": "mae.forex", "columns": {"monto": "volumen"}}}}
+	]`
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SYNC_DESTINATIONS_FILE", path)
+	t.Setenv("TEST_SYNC_PASSWORD", "secret")
+
+	dests, err := loadDestinations()
+	if err != nil {
+		t.Fatalf("loadDestinations() error: %v", err)
+	}
+	if len(dests) != 2 {
+		t.Fatalf("got %d destinations, want 2", len(dests))
+	}
+	if d := dests[0]; d.Password != "secret" {
+		t.Errorf("password not read from passwordEnv: %+v", d)
+	}
+	ts := newTableSync(dests[1], defaultTables[0])
+	if got, want := ts.cols([]string{"date", "monto", "cotizacion"}), []string{`"date"`, `"volumen"`, `"cotizacion"`}; ts.target != "mae.forex" || !slices.Equal(got, want) {
+		t.Errorf("newTableSync() target = %s, cols = %v, want mae.forex, %v", ts.target, got, want)
+	}
+
+	if err := os.WriteFile(path, []byte(`[{"name": "a"}, {"name": "a"}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadDestinations(); err == nil {
+		t.Error("loadDestinations() accepted duplicate names")
+	}
+}
+
+func TestDiffSchema(t *testing.T) {
+	spec := &tableSpec{Name: forexTable, Incremental: "date"}
+	local := []column{{"date", "date"}, {"rueda", "text"}, {"instrumento", "text"}, {"monto", "double precision"}, {"extra_fields", "jsonb"}}
+	if err := spec.setColumns(local); err != nil {
+		t.Fatal(err)
+	}
+	spec.setIndexes([]index{
+		{Name: "forex_natural_key", Unique: true, Columns: []string{"date", "rueda", "instrumento"}},
+		{Name: "forex_updated_at_idx", Columns: []string{"updated_at"}}, // not copied
+		{Name: "forex_monto_idx", Columns: []string{"monto"}},
+	})
+	d := &destination{Name: "replica", Tables: map[string]tableMapping{
+		forexTable: {Columns: map[string]string{"monto": "volumen"}},
+	}}
+	ts := newTableSync(d, spec)
+
+	dest := []column{{"date", "date"}, {"rueda", "text"}, {"instrumento", "character varying(20)"}, {"volumen", "double precision"}, {"loaded_at", "timestamp with time zone"}}
+	destIndexes := []index{{Name: "forex_uk", Unique: true, Columns: []string{"date", "rueda", "instrumento"}}}
+	diff := diffSchema(ts, dest, destIndexes)
+
+	if diff.MissingTable {
+		t.Error("MissingTable = true for an existing table")
+	}
+	if want := []column{{"extra_fields", "jsonb"}}; !slices.Equal(diff.AddColumns, want) {
+		t.Errorf("AddColumns = %v, want %v", diff.AddColumns, want)
+	}
+	if want := []string{"instrumento: text vs character varying(20)"}; !slices.Equal(diff.TypeChanged, want) {
+		t.Errorf("TypeChanged = %v, want %v", diff.TypeChanged, want)
+	}
+	if want := []string{"loaded_at"}; !slices.Equal(diff.Extra, want) {
+		t.Errorf("Extra = %v, want %v", diff.Extra, want)
+	}
+
+	got := diff.statements("public.forex")
+	want := []string{
+		`ALTER TABLE "public"."forex" ADD COLUMN IF NOT EXISTS "extra_fields" jsonb`,
+		`CREATE INDEX IF NOT EXISTS "forex_monto_idx" ON "public"."forex" ("volumen")`,
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("statements() =\n%v\nwant\n%v", got, want)
+	}
+
+	missing := diffSchema(ts, nil, nil)
+	got = missing.statements("public.forex")
+	if len(got) != 3 || got[0] != `CREATE TABLE "public"."forex" ("date" date, "rueda" text, "instrumento" text, "volumen" double precision, "extra_fields" jsonb)` {
+		t.Errorf("statements() for a missing table = %v", got)
+	}
+}
+
+func TestSplitDates(t *testing.T) {
+	pending := []pendingDate{
+		{day("2024-11-11"), 100}, {day("2024-11-12"), 100}, {day("2024-11-13"), 100},
+		{day("2024-11-14"), 100}, {day("2024-11-15"), 400}, {day("2024-11-18"), 10},
+	}
+
+	sizes := func(groups [][]pendingDate) []int {
+		var n []int
+		for _, g := range groups {
+			n = append(n, len(g))
+		}
+		return n
+	}
+	tests := []struct {
+		workers int
+		want    []int
+	}{
+		{1, []int{6}},
+		{2, []int{4, 2}},
+		{3, []int{3, 1, 2}},
+		{10, []int{1, 1, 1, 1, 1, 1}},
+	}
+	for _, tt := range tests {
+		groups := splitDates(pending, tt.workers)
+		if got := sizes(groups); !slices.Equal(got, tt.want) {
+			t.Errorf("splitDates(%d workers) sizes = %v, want %v", tt.workers, got, tt.want)
+		}
+		var joined []pendingDate
+		for _, g := range groups {
+			joined = append(joined, g...)
+		}
+		if !slices.Equal(joined, pending) {
+			t.Errorf("splitDates(%d workers) lost or reordered dates", tt.workers)
+		}
+	}
+
+	if got, want := dateArray(pending[:2]), "{2024-11-11,2024-11-12}"; got != want {
+		t.Errorf("dateArray() = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,349 @@
+package syncforex
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// tableSpec is a local table synced to the destinations. Rows are copied one
+// day of the incremental column at a time and upserted on the key, so a row
+// whose incremental value moves to another day is replaced, not duplicated.
+type tableSpec struct {
+	Name        string   `json:"name"`        // schema qualified, e.g. public.forex
+	Key         []string `json:"key"`         // unique on the destination; without it rows are only inserted
+	Incremental string   `json:"incremental"` // date or timestamp column
+	Exclude     []string `json:"exclude"`     // local-only columns that are not copied
+	Changed     string   `json:"changed"`     // timestamp set on every change, used by push; defaults to incremental
+
+	columns []column // copied columns in table order, read from the local catalog
+	indexes []index  // local indexes over copied columns, see alignSchema
+}
+
+// column is a table column and its type as printed by format_type, e.g.
+// numeric(18,4) or timestamp with time zone.
+type column struct {
+	Name string
+	Type string
+}
+
+// defaultTables is used when SYNC_TABLES_FILE is not set. created_at and
+// updated_at only track local changes for the cdc mode.
+var defaultTables = []*tableSpec{{
+	Name:        forexTable,
+	Key:         []string{"date", "rueda", "instrumento"},
+	Incremental: "date",
+	Exclude:     []string{"created_at", "updated_at"},
+	Changed:     "updated_at",
+}}
+
+// loadTables reads the synced tables from the JSON file named by
+// SYNC_TABLES_FILE, e.g.
+//
+//	[
+//	  {"name": "public.forex", "key": ["date", "rueda", "instrumento"],
+//	   "incremental": "date", "exclude": ["created_at", "updated_at"], "changed": "updated_at"},
+//	  {"name": "public.forex_instruments", "key": ["ticker", "codigo_segmento"],
+//	   "incremental": "last_seen"}
+//	]
+//
+// Columns and their types are read from the local database by describeTables,
+// so adding a table only needs a new entry.
+func loadTables() ([]*tableSpec, error) {
+	path := os.Getenv("SYNC_TABLES_FILE")
+	if path == "" {
+		return defaultTables, nil
+	}
+
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var specs []*tableSpec
+	if err := json.Unmarshal(body, &specs); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("%s lists no tables", path)
+	}
+
+	seen := map[string]bool{}
+	for i, s := range specs {
+		if s.Name == "" {
+			return nil, fmt.Errorf("table %d has no name", i+1)
+		}
+		if seen[s.Name] {
+			return nil, fmt.Errorf("duplicate table '%s'", s.Name)
+		}
+		seen[s.Name] = true
+		if s.Incremental == "" {
+			return nil, fmt.Errorf("table '%s' has no incremental column", s.Name)
+		}
+	}
+	return specs, nil
+}
+
+// describeTables reads the columns and indexes of every table from the local
+// catalog and checks the key and incremental columns against them.
+func describeTables(ctx context.Context, conn *pgx.Conn, specs []*tableSpec) error {
+	for _, s := range specs {
+		all, err := readColumns(ctx, conn, s.Name)
+		if err != nil {
+			return fmt.Errorf("describe %s: %w", s.Name, err)
+		}
+		if err := s.setColumns(all); err != nil {
+			return err
+		}
+		indexes, err := readIndexes(ctx, conn, s.Name)
+		if err != nil {
+			return fmt.Errorf("describe %s indexes: %w", s.Name, err)
+		}
+		s.setIndexes(indexes)
+	}
+	return nil
+}
+
+// readColumns returns the columns of a table in table order.
+func readColumns(ctx context.Context, conn *pgx.Conn, table string) ([]column, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT attname, format_type(atttypid, atttypmod)
+		FROM pg_attribute
+		WHERE attrelid = $1::text::regclass AND attnum > 0 AND NOT attisdropped
+		ORDER BY attnum`, table)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[column])
+}
+
+// setColumns keeps the copied columns and validates the spec against them.
+func (s *tableSpec) setColumns(all []column) error {
+	s.columns = nil
+	for _, c := range all {
+		if !slices.Contains(s.Exclude, c.Name) {
+			s.columns = append(s.columns, c)
+		}
+	}
+
+	inc, ok := s.column(s.Incremental)
+	if !ok {
+		return fmt.Errorf("table %s: incremental column '%s' is missing or excluded", s.Name, s.Incremental)
+	}
+	if partitionExpr(quoteIdent(inc.Name), inc.Type) == "" {
+		return fmt.Errorf("table %s: incremental column '%s' is %s, not a date or timestamp", s.Name, inc.Name, inc.Type)
+	}
+	for _, k := range s.Key {
+		if _, ok := s.column(k); !ok {
+			return fmt.Errorf("table %s: key column '%s' is missing or excluded", s.Name, k)
+		}
+	}
+	if s.Changed != "" && !slices.ContainsFunc(all, func(c column) bool { return c.Name == s.Changed }) {
+		return fmt.Errorf("table %s: changed column '%s' is missing", s.Name, s.Changed)
+	}
+	return nil
+}
+
+// withoutChanged returns copies of the specs without a changed column, for
+// serve: changes are tracked on the pushing side, and the ingest server's
+// database, the cloud one, does not get the local-only change tracking
+// columns.
+func withoutChanged(specs []*tableSpec) []*tableSpec {
+	out := make([]*tableSpec, len(specs))
+	for i, s := range specs {
+		c := *s
+		c.Changed = ""
+		out[i] = &c
+	}
+	return out
+}
+
+// changedColumn is the column push selects new and changed rows by.
+func (s *tableSpec) changedColumn() string {
+	if s.Changed != "" {
+		return s.Changed
+	}
+	return s.Incremental
+}
+
+func (s *tableSpec) column(name string) (column, bool) {
+	for _, c := range s.columns {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return column{}, false
+}
+
+// columnNames returns the names of the copied columns.
+func (s *tableSpec) columnNames() []string {
+	names := make([]string, len(s.columns))
+	for i, c := range s.columns {
+		names[i] = c.Name
+	}
+	return names
+}
+
+// tableSync is one table synced to one destination, with the destination's
+// table and column names.
+type tableSync struct {
+	*tableSpec
+	dest   *destination
+	target string            // destination table
+	rename map[string]string // local column -> destination column
+}
+
+func newTableSync(d *destination, s *tableSpec) *tableSync {
+	t := &tableSync{tableSpec: s, dest: d, target: s.Name}
+	if m, ok := d.Tables[s.Name]; ok {
+		if m.Table != "" {
+			t.target = m.Table
+		}
+		t.rename = m.Columns
+	}
+	return t
+}
+
+// col returns the destination name of a local column.
+func (t *tableSync) col(name string) string {
+	if mapped, ok := t.rename[name]; ok {
+		return mapped
+	}
+	return name
+}
+
+// cols maps local column names to quoted destination names.
+func (t *tableSync) cols(names []string) []string {
+	mapped := make([]string, len(names))
+	for i, c := range names {
+		mapped[i] = quoteIdent(t.col(c))
+	}
+	return mapped
+}
+
+// localPartition and targetPartition are the SQL expressions giving the day
+// of a row on each side.
+func (t *tableSync) localPartition() string {
+	inc, _ := t.column(t.Incremental)
+	return partitionExpr(quoteIdent(inc.Name), inc.Type)
+}
+
+func (t *tableSync) targetPartition() string {
+	inc, _ := t.column(t.Incremental)
+	return partitionExpr(quoteIdent(t.col(inc.Name)), inc.Type)
+}
+
+// selectText selects the copied columns as text, the form in which they are
+// passed to insertQuery, so every column type round-trips unchanged.
+func (s *tableSpec) selectText() string {
+	list := make([]string, len(s.columns))
+	for i, c := range s.columns {
+		list[i] = quoteIdent(c.Name) + "::text"
+	}
+	return strings.Join(list, ", ")
+}
+
+// upsert returns the statement that writes one row selected with selectText.
+func (t *tableSync) upsert() string {
+	targetCols := make([]column, len(t.columns))
+	for i, c := range t.columns {
+		targetCols[i] = column{Name: t.col(c.Name), Type: c.Type}
+	}
+	key := make([]string, len(t.Key))
+	for i, k := range t.Key {
+		key[i] = t.col(k)
+	}
+	return insertQuery(t.target, targetCols, key)
+}
+
+// log returns the logger for this table's records on its destination.
+func (t *tableSync) log() *slog.Logger {
+	return t.dest.log().With("table", t.Name)
+}
+
+// insertQuery builds an INSERT taking every value as text and casting it to
+// the column type. With a key it becomes an upsert, see conflictClause.
+func insertQuery(table string, cols []column, key []string) string {
+	names := make([]string, len(cols))
+	placeholders := make([]string, len(cols))
+	for i, c := range cols {
+		names[i] = quoteIdent(c.Name)
+		placeholders[i] = fmt.Sprintf("$%d::text::%s", i+1, c.Type)
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)%s",
+		quoteTable(table), strings.Join(names, ", "), strings.Join(placeholders, ", "), conflictClause(names, quoteAll(key)))
+}
+
+// conflictClause returns the ON CONFLICT clause that makes an insert of the
+// quoted columns an upsert on the quoted key, setting every non-key column
+// from the inserted values. It is empty without a key.
+func conflictClause(cols, key []string) string {
+	if len(key) == 0 {
+		return ""
+	}
+	var updates []string
+	for _, c := range cols {
+		if !slices.Contains(key, c) {
+			updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", c, c))
+		}
+	}
+	if len(updates) == 0 {
+		return fmt.Sprintf(" ON CONFLICT (%s) DO NOTHING", strings.Join(key, ", "))
+	}
+	return fmt.Sprintf(" ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(key, ", "), strings.Join(updates, ", "))
+}
+
+// partitionExpr returns the day of a date or timestamp column, in UTC for
+// timestamptz so both databases agree regardless of their time zone. It
+// returns "" for other types.
+func partitionExpr(col, typ string) string {
+	switch typ {
+	case "date":
+		return col
+	case "timestamp without time zone":
+		return col + "::date"
+	case "timestamp with time zone":
+		return fmt.Sprintf("(%s AT TIME ZONE 'UTC')::date", col)
+	}
+	return ""
+}
+
+// scanText scans the current row, selected with selectText, into values ready
+// to be passed to an upsert.
+func scanText(rows pgx.Rows, n int) ([]any, error) {
+	values := make([]*string, n)
+	dest := make([]any, n)
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return nil, err
+	}
+	args := make([]any, n)
+	for i, v := range values {
+		args[i] = v
+	}
+	return args, nil
+}
+
+func quoteIdent(name string) string {
+	return pgx.Identifier{name}.Sanitize()
+}
+
+func quoteAll(names []string) []string {
+	quoted := make([]string, len(names))
+	for i, n := range names {
+		quoted[i] = quoteIdent(n)
+	}
+	return quoted
+}
+
+// quoteTable quotes a possibly schema qualified table name.
+func quoteTable(name string) string {
+	return pgx.Identifier(strings.Split(name, ".")).Sanitize()
+}
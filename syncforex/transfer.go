@@ -0,0 +1,282 @@
+package syncforex
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmtruffa/maescraper/dbconfig"
+	"github.com/jmtruffa/maescraper/metrics"
+)
+
+const (
+	// defaultSyncWorkers is how many COPY streams run in parallel per table
+	// and destination. Override with SYNC_WORKERS.
+	defaultSyncWorkers = 4
+
+	progressInterval = 10 * time.Second
+)
+
+// transferStats counts what the workers have streamed so far.
+type transferStats struct {
+	rows  atomic.Int64
+	bytes atomic.Int64
+}
+
+// countingWriter counts the bytes and rows passing through. In COPY text
+// format every row is one line; newlines inside values are escaped.
+type countingWriter struct {
+	w     io.Writer
+	stats *transferStats
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.stats.bytes.Add(int64(n))
+	c.stats.rows.Add(int64(bytes.Count(p[:n], []byte{'\n'})))
+	return n, err
+}
+
+// transfer copies the local rows of the pending dates into the destination.
+// The dates are split into contiguous groups of similar size, and each group
+// is streamed by its own worker from COPY TO on the local database into COPY
+// FROM on a destination staging table. Once every worker has finished, a
+// single transaction replaces the dates in the destination table with the
+// staged rows and records them as synced. If any worker fails nothing is
+// merged and the dates are retried on the next run; the same goes when ctx
+// is cancelled.
+func transfer(ctx context.Context, t *tableSync, pending []pendingDate) (int64, error) {
+	conn := t.dest.conn
+	staging := t.target + "_staging"
+
+	// A leftover from an interrupted run is discarded
+	if _, err := conn.Exec(ctx, "DROP TABLE IF EXISTS "+quoteTable(staging)); err != nil {
+		return 0, fmt.Errorf("drop old staging table: %w", err)
+	}
+	_, err := conn.Exec(ctx, fmt.Sprintf("CREATE UNLOGGED TABLE %s (LIKE %s INCLUDING DEFAULTS)",
+		quoteTable(staging), quoteTable(t.target)))
+	if err != nil {
+		return 0, fmt.Errorf("create staging table: %w", err)
+	}
+	defer conn.Exec(context.WithoutCancel(ctx), "DROP TABLE IF EXISTS "+quoteTable(staging))
+
+	groups := splitDates(pending, syncWorkers())
+	t.log().Info("Copying dates", "dates", len(pending), "workers", len(groups))
+
+	var stats transferStats
+	start := time.Now()
+	done := make(chan struct{})
+	go reportProgress(t, &stats, start, done)
+
+	errs := make([]error, len(groups))
+	var wg sync.WaitGroup
+	for i, g := range groups {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = copyDates(ctx, t, staging, g, &stats)
+		}()
+	}
+	wg.Wait()
+	close(done)
+	if err := errors.Join(errs...); err != nil {
+		return 0, err
+	}
+
+	elapsed := time.Since(start)
+	metrics.ObserveDBWrite("syncforex", "copy", start)
+	mb := float64(stats.bytes.Load()) / (1 << 20)
+	t.log().Info("Copied rows", "rows", stats.rows.Load(), "mb", round2(mb), "elapsed", elapsed.Round(time.Millisecond),
+		"rows_per_second", int64(float64(stats.rows.Load())/elapsed.Seconds()), "mb_per_second", round2(mb/elapsed.Seconds()))
+
+	start = time.Now()
+	n, err := mergeStaging(ctx, t, staging, pending)
+	if err == nil {
+		metrics.ObserveDBWrite("syncforex", "merge", start)
+	}
+	return n, err
+}
+
+// copyDates streams the rows of a group of dates from the local table into the
+// staging table, over connections of its own.
+func copyDates(ctx context.Context, t *tableSync, staging string, dates []pendingDate, stats *transferStats) error {
+	localConn, err := connectLocal(ctx)
+	if err != nil {
+		return fmt.Errorf("connect to local database: %w", err)
+	}
+	defer localConn.Close(context.Background())
+	destConn, err := t.dest.connect(ctx)
+	if err != nil {
+		return fmt.Errorf("connect to destination database: %w", err)
+	}
+	defer destConn.Close(context.Background())
+
+	localCols := make([]string, len(t.columns))
+	for i, c := range t.columns {
+		localCols[i] = quoteIdent(c.Name)
+	}
+	// COPY takes no parameters; the dates are formatted here, not user input
+	copyOut := fmt.Sprintf("COPY (SELECT %s FROM %s WHERE %s = ANY('%s'::date[])) TO STDOUT",
+		strings.Join(localCols, ", "), quoteTable(t.Name), t.localPartition(), dateArray(dates))
+	copyIn := fmt.Sprintf("COPY %s (%s) FROM STDIN",
+		quoteTable(staging), strings.Join(t.cols(t.columnNames()), ", "))
+
+	pr, pw := io.Pipe()
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := localConn.PgConn().CopyTo(ctx, countingWriter{pw, stats}, copyOut)
+		pw.CloseWithError(err)
+		readErr <- err
+	}()
+
+	_, err = destConn.PgConn().CopyFrom(ctx, pr, copyIn)
+	// Unblocks the reader if the destination stopped early
+	pr.CloseWithError(errors.New("destination copy ended"))
+	if rerr := <-readErr; rerr != nil && err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return fmt.Errorf("copy %s to %s: %w", dates[0].Date.Format("2006-01-02"),
+			dates[len(dates)-1].Date.Format("2006-01-02"), err)
+	}
+	return nil
+}
+
+// mergeStaging replaces the pending dates in the destination table with the
+// staged rows and records the dates as synced, in one transaction.
+func mergeStaging(ctx context.Context, t *tableSync, staging string, pending []pendingDate) (int64, error) {
+	dates := make([]time.Time, len(pending))
+	for i, p := range pending {
+		dates[i] = p.Date
+	}
+	cols := strings.Join(t.cols(t.columnNames()), ", ")
+	key := make([]string, len(t.Key))
+	for i, k := range t.Key {
+		key[i] = t.col(k)
+	}
+
+	tx, err := t.dest.conn.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("begin merge: %w", err)
+	}
+	defer dbconfig.Rollback(ctx, tx)
+
+	deleteQuery := fmt.Sprintf("DELETE FROM %s WHERE %s = ANY($1::date[])", quoteTable(t.target), t.targetPartition())
+	if _, err := tx.Exec(ctx, deleteQuery, dates); err != nil {
+		return 0, fmt.Errorf("delete destination rows: %w", err)
+	}
+	insertQuery := fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s%s",
+		quoteTable(t.target), cols, cols, quoteTable(staging), conflictClause(t.cols(t.columnNames()), quoteAll(key)))
+	tag, err := tx.Exec(ctx, insertQuery)
+	if err != nil {
+		return 0, fmt.Errorf("merge staged rows: %w", err)
+	}
+
+	// Dates emptied locally since the counts were taken are recorded with 0 rows
+	stateQuery := fmt.Sprintf(`
+		INSERT INTO public.sync_state (table_name, date, row_count, synced_at)
+		SELECT $1, d.date, COALESCE(c.n, 0), now()
+		FROM unnest($2::date[]) AS d(date)
+		LEFT JOIN (SELECT %s AS date, COUNT(*) AS n FROM %s GROUP BY 1) c USING (date)
+		ON CONFLICT (table_name, date) DO UPDATE
+		SET row_count = EXCLUDED.row_count, synced_at = EXCLUDED.synced_at`,
+		t.targetPartition(), quoteTable(staging))
+	if _, err := tx.Exec(ctx, stateQuery, t.target, dates); err != nil {
+		return 0, fmt.Errorf("record sync state: %w", err)
+	}
+	if _, err := tx.Exec(ctx, "DROP TABLE "+quoteTable(staging)); err != nil {
+		return 0, fmt.Errorf("drop staging table: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("commit merge: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// splitDates splits the dates, in order, into at most n contiguous groups with
+// similar row counts.
+func splitDates(pending []pendingDate, n int) [][]pendingDate {
+	if n > len(pending) {
+		n = len(pending)
+	}
+	if n <= 1 {
+		if len(pending) == 0 {
+			return nil
+		}
+		return [][]pendingDate{pending}
+	}
+
+	var total int64
+	for _, p := range pending {
+		total += p.LocalCount
+	}
+
+	var groups [][]pendingDate
+	var current []pendingDate
+	var sum int64
+	for i, p := range pending {
+		// Close the group before the date that would overshoot its share
+		// the most, or when every remaining date needs a group of its own
+		share := total * int64(len(groups)+1) / int64(n)
+		need := n - 1 - len(groups)
+		left := len(pending) - i
+		if len(current) > 0 && need > 0 && (sum+p.LocalCount-share > share-sum || left == need) {
+			groups = append(groups, current)
+			current = nil
+		}
+		current = append(current, p)
+		sum += p.LocalCount
+	}
+	if len(current) > 0 {
+		groups = append(groups, current)
+	}
+	return groups
+}
+
+// dateArray formats the dates as a PostgreSQL array literal.
+func dateArray(dates []pendingDate) string {
+	list := make([]string, len(dates))
+	for i, p := range dates {
+		list[i] = p.Date.Format("2006-01-02")
+	}
+	return "{" + strings.Join(list, ",") + "}"
+}
+
+func reportProgress(t *tableSync, stats *transferStats, start time.Time, done <-chan struct{}) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			mb := float64(stats.bytes.Load()) / (1 << 20)
+			t.log().Info("Copy progress", "rows", stats.rows.Load(), "mb", round2(mb), "mb_per_second", round2(mb/time.Since(start).Seconds()))
+		}
+	}
+}
+
+func syncWorkers() int {
+	if v := envOrDefault("SYNC_WORKERS", ""); v != "" {
+		n, err := strconv.Atoi(v)
+		if err == nil && n > 0 {
+			return n
+		}
+		slog.Warn("Invalid SYNC_WORKERS, using the default", "value", v, "default", defaultSyncWorkers)
+	}
+	return defaultSyncWorkers
+}
+
+// round2 rounds to two decimals, for rates in log records.
+func round2(f float64) float64 {
+	return math.Round(f*100) / 100
+}
@@ -0,0 +1,160 @@
+package syncforex
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jmtruffa/maescraper/dbconfig"
+)
+
+// dateChecksum summarizes the rows of one date: how many there are and an
+// order-independent hash of their contents.
+type dateChecksum struct {
+	Count int64
+	Hash  string
+}
+
+// checksumsByDate computes a dateChecksum for every date of the table, with
+// dateExpr giving the date of a row. Each row is hashed from its text
+// representation over the given columns, and the row hashes are sorted before
+// being combined, so the result does not depend on physical row order. Both
+// databases must use the same column types.
+func checksumsByDate(ctx context.Context, conn *pgx.Conn, table string, columns []string, dateExpr string) (map[time.Time]dateChecksum, error) {
+	query := fmt.Sprintf(`
+		SELECT %s, COUNT(*), md5(string_agg(md5(t::text), '' ORDER BY md5(t::text)))
+		FROM (SELECT %s FROM %s) t
+		GROUP BY 1`, dateExpr, strings.Join(columns, ", "), table)
+	rows, err := conn.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sums := make(map[time.Time]dateChecksum)
+	for rows.Next() {
+		var date time.Time
+		var c dateChecksum
+		if err := rows.Scan(&date, &c.Count, &c.Hash); err != nil {
+			return nil, err
+		}
+		sums[date] = c
+	}
+	return sums, rows.Err()
+}
+
+// mismatchedDates returns, in date order, the dates whose checksum differs
+// between local and destination, including dates present on only one side.
+func mismatchedDates(local, cloud map[time.Time]dateChecksum) []time.Time {
+	var dates []time.Time
+	for date, l := range local {
+		if c, ok := cloud[date]; !ok || c != l {
+			dates = append(dates, date)
+		}
+	}
+	for date := range cloud {
+		if _, ok := local[date]; !ok {
+			dates = append(dates, date)
+		}
+	}
+	sort.Slice(dates, func(i, j int) bool { return dates[i].Before(dates[j]) })
+	return dates
+}
+
+// verify compares the local and destination table per date and lists the dates that differ.
+func verify(ctx context.Context, localConn *pgx.Conn, t *tableSync) ([]time.Time, map[time.Time]dateChecksum, error) {
+	localCols := make([]string, len(t.columns))
+	for i, c := range t.columns {
+		localCols[i] = quoteIdent(c.Name)
+	}
+	local, err := checksumsByDate(ctx, localConn, quoteTable(t.Name), localCols, t.localPartition())
+	if err != nil {
+		t.log().Error("Verification failed", "error", err)
+		return nil, nil, fmt.Errorf("checksum local rows: %w", err)
+	}
+	cloud, err := checksumsByDate(ctx, t.dest.conn, quoteTable(t.target), t.cols(t.columnNames()), t.targetPartition())
+	if err != nil {
+		t.log().Error("Verification failed", "error", err)
+		return nil, nil, fmt.Errorf("checksum destination rows: %w", err)
+	}
+
+	mismatched := mismatchedDates(local, cloud)
+	t.log().Info("Compared local and destination dates", "local", len(local), "destination_dates", len(cloud), "differ", len(mismatched))
+	for _, date := range mismatched {
+		l, c := local[date], cloud[date]
+		t.log().Warn("Date differs", "date", date.Format("2006-01-02"),
+			"local_rows", l.Count, "local_hash", shortHash(l.Hash), "destination_rows", c.Count, "destination_hash", shortHash(c.Hash))
+	}
+	return mismatched, local, nil
+}
+
+// repair replaces the destination rows of every mismatching date with the
+// local version. Dates that only exist in the destination are deleted there.
+func repair(ctx context.Context, localConn *pgx.Conn, t *tableSync) error {
+	mismatched, local, err := verify(ctx, localConn, t)
+	if err != nil {
+		return err
+	}
+
+	var copies []pendingDate
+	repaired, failed := 0, 0
+	for _, date := range mismatched {
+		if l, ok := local[date]; ok {
+			copies = append(copies, pendingDate{Date: date, LocalCount: l.Count})
+			continue
+		}
+		if err := deleteDestinationDate(ctx, t, date); err != nil {
+			t.log().Error("Failed to repair date", "date", date.Format("2006-01-02"), "error", err)
+			failed++
+			continue
+		}
+		repaired++
+	}
+	if len(copies) > 0 {
+		t.dest.run.SetRange(copies[0].Date, copies[len(copies)-1].Date)
+		if rows, err := transfer(ctx, t, copies); err != nil {
+			t.log().Error("Failed to repair dates", "dates", len(copies), "error", err)
+			failed += len(copies)
+		} else {
+			repaired += len(copies)
+			t.dest.run.Add(0, int(rows), 0, 0)
+		}
+	}
+
+	t.log().Info("Repaired dates", "dates", repaired, "target", t.target)
+	if repaired > 0 {
+		t.dest.run.Completed("%s: %s, %d fechas reparadas", t.dest.Name, t.Name, repaired)
+	}
+	if failed > 0 {
+		t.log().Error("Some dates could not be repaired", "dates", failed)
+		return fmt.Errorf("%d dates could not be repaired", failed)
+	}
+	return nil
+}
+
+// deleteDestinationDate removes a date that no longer exists locally, together with its sync state.
+func deleteDestinationDate(ctx context.Context, t *tableSync, date time.Time) error {
+	tx, err := t.dest.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer dbconfig.Rollback(ctx, tx)
+
+	if _, err := tx.Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE %s = $1", quoteTable(t.target), t.targetPartition()), date); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM public.sync_state WHERE table_name = $1 AND date = $2", t.target, date); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func shortHash(h string) string {
+	if len(h) < 8 {
+		return h
+	}
+	return h[:8]
+}